@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+)
+
+// An accessRecord is a structured access log entry.
+type accessRecord struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Module    string  `json:"module,omitempty"`
+	Version   string  `json:"version,omitempty"`
+	Kind      string  `json:"kind,omitempty"`
+	Mode      string  `json:"mode,omitempty"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Client    string  `json:"client"`
+	User      string  `json:"user,omitempty"` // verified identity, if any
+}
+
+// An accessLogger writes access records in the given format:
+// "text" (the historical one-line format), "json" or "logfmt".
+type accessLogger struct {
+	format string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newAccessLogger(w io.Writer, format string) (*accessLogger, error) {
+	switch format {
+	case "text", "json", "logfmt":
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	return &accessLogger{format: format, w: w}, nil
+}
+
+func (l *accessLogger) log(rec *accessRecord) {
+	var buf bytes.Buffer
+	switch l.format {
+	case "text":
+		fmt.Fprintf(&buf, "%.3fs %d %s\n", rec.Duration, rec.Status, rec.Path)
+	case "json":
+		json.NewEncoder(&buf).Encode(rec)
+	default:
+		fmt.Fprintf(&buf, "time=%s request_id=%s method=%s path=%s",
+			logfmtValue(rec.Time), logfmtValue(rec.RequestID), logfmtValue(rec.Method), logfmtValue(rec.Path))
+		for _, kv := range [][2]string{{"module", rec.Module}, {"version", rec.Version}, {"kind", rec.Kind}, {"mode", rec.Mode}} {
+			if kv[1] != "" {
+				fmt.Fprintf(&buf, " %s=%s", kv[0], logfmtValue(kv[1]))
+			}
+		}
+		fmt.Fprintf(&buf, " status=%d bytes=%d duration=%.3f client=%s", rec.Status, rec.Bytes, rec.Duration, logfmtValue(rec.Client))
+		if rec.User != "" {
+			fmt.Fprintf(&buf, " user=%s", logfmtValue(rec.User))
+		}
+		buf.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// logfmtValue quotes s if needed, so that values sent by clients
+// cannot forge fields or records.
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// maxRequestID is the maximum length of the request IDs sent by clients.
+const maxRequestID = 128
+
+// requestID returns the ID of the request r, generating one unless
+// the client or a front proxy sent a valid X-Request-Id header:
+// at most maxRequestID bytes of letters, digits, '.', '_' and '-'.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); validRequestID(id) {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteIP returns the IP address of the client sending r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// A rotatingFile is a log file renamed to path.1, path.2 and so on
+// once it grows past maxSize, keeping at most backups old files.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write implements io.Writer.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files and starts a new one. rf.mu must be held.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	for i := rf.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if rf.backups > 0 {
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+	return rf.open()
+}
+
+// newAccessRecord returns the access record of r, answered by rl.
+// The user is the one verified by identify, if not nil.
+func newAccessRecord(r *http.Request, info *proxy.RequestInfo, rl *responseLogger, id string, start time.Time, identify func(*http.Request) (string, bool)) *accessRecord {
+	rec := &accessRecord{
+		Time:      start.UTC().Format(time.RFC3339Nano),
+		RequestID: id,
+		Method:    r.Method,
+		Path:      r.URL.RequestURI(),
+		Module:    info.Module,
+		Version:   info.Version,
+		Kind:      info.Kind,
+		Mode:      info.Mode,
+		Status:    rl.code,
+		Bytes:     rl.bytes,
+		Duration:  time.Since(start).Seconds(),
+		Client:    remoteIP(r),
+	}
+	if identify != nil {
+		if user, ok := identify(r); ok {
+			rec.User = user
+		}
+	}
+	return rec
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	rec := &accessRecord{
+		Time:      "2024-01-02T03:04:05Z",
+		RequestID: "abc status=200\nforged=1",
+		Method:    "GET",
+		Path:      "/example.com/m/@v/v1.0.0.info",
+		Module:    "example.com/m",
+		Version:   "v1.0.0",
+		Kind:      "info",
+		Status:    200,
+		Bytes:     42,
+		Duration:  0.0125,
+		Client:    "192.0.2.1",
+		User:      `a"b`,
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"text", "0.013s 200 /example.com/m/@v/v1.0.0.info\n"},
+		{"json", `{"time":"2024-01-02T03:04:05Z","request_id":"abc status=200\nforged=1","method":"GET",` +
+			`"path":"/example.com/m/@v/v1.0.0.info","module":"example.com/m","version":"v1.0.0","kind":"info",` +
+			`"status":200,"bytes":42,"duration":0.0125,"client":"192.0.2.1","user":"a\"b"}` + "\n"},
+		{"logfmt", `time=2024-01-02T03:04:05Z request_id="abc status=200\nforged=1" method=GET ` +
+			`path=/example.com/m/@v/v1.0.0.info module=example.com/m version=v1.0.0 kind=info ` +
+			`status=200 bytes=42 duration=0.013 client=192.0.2.1 user="a\"b"` + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		l, err := newAccessLogger(&buf, tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.log(rec)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.format, got, tt.want)
+		}
+	}
+	if _, err := newAccessLogger(ioutil.Discard, "xml"); err == nil {
+		t.Error("newAccessLogger accepted an unknown format")
+	}
+}
+
+func TestLogfmtValue(t *testing.T) {
+	for s, want := range map[string]string{
+		"":            `""`,
+		"plain":       "plain",
+		"a b":         `"a b"`,
+		"k=v":         `"k=v"`,
+		"a\rb":        `"a\rb"`,
+		"\x1b[31m":    `"\x1b[31m"`,
+		"/ü/@v/list":  "/ü/@v/list",
+		`say "hello"`: `"say \"hello\""`,
+	} {
+		if got := logfmtValue(s); got != want {
+			t.Errorf("logfmtValue(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for id, kept := range map[string]bool{
+		"abc-123_x.y":              true,
+		strings.Repeat("a", 128):   true,
+		strings.Repeat("a", 129):   false,
+		"abc status=200\nforged=1": false,
+		"<script>":                 false,
+		"\u00fc":                   false,
+		"":                         false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Request-Id", id)
+		got := requestID(r)
+		if kept && got != id || !kept && (got == id || !validRequestID(got)) {
+			t.Errorf("requestID with X-Request-Id %q = %q", id, got)
+		}
+	}
+}
+
+func TestAccessRecordUser(t *testing.T) {
+	u := proxy.NewUploads("", []string{"secret"})
+	id, _ := u.Identity(&http.Request{Header: http.Header{"Authorization": {"Bearer secret"}}})
+	for _, tt := range []struct {
+		pass     string
+		identify func(*http.Request) (string, bool)
+		want     string
+	}{
+		{"secret", u.Identity, id},
+		// Unverified users are not logged.
+		{"guess", u.Identity, ""},
+		{"secret", nil, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("alice", tt.pass)
+		r, info := proxy.WithRequestInfo(r)
+		rec := newAccessRecord(r, info, &responseLogger{code: 200}, "abc", time.Now(), tt.identify)
+		if rec.User != tt.want {
+			t.Errorf("password %q: got user %q, want %q", tt.pass, rec.User, tt.want)
+		}
+	}
+}
+
+func TestAccessLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-accesslog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+
+	rf, err := openRotatingFile(file, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newAccessLogger(rf, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each record is 40 bytes, so a file holds two of them.
+	for i := 0; i < 7; i++ {
+		l.log(&accessRecord{Status: 200, Path: fmt.Sprintf("/example.com/m/@v/v1.0.%d.info", i), Duration: 1})
+	}
+	rf.f.Close()
+
+	for name, want := range map[string]string{
+		"access.log":   "1.000s 200 /example.com/m/@v/v1.0.6.info\n",
+		"access.log.1": "1.000s 200 /example.com/m/@v/v1.0.4.info\n1.000s 200 /example.com/m/@v/v1.0.5.info\n",
+		"access.log.2": "1.000s 200 /example.com/m/@v/v1.0.2.info\n1.000s 200 /example.com/m/@v/v1.0.3.info\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s:\ngot  %q\nwant %q", name, data, want)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("got %s.3, want at most 2 backups", file)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once the shutdown started, making /readyz fail
+// so that load balancers stop sending new requests.
+var draining int32
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// stopCtx is cancelled when the drain period is over,
+// aborting the go commands still running.
+var stopCtx, abortInflight = context.WithCancel(context.Background())
+
+// errShutdown reports a go command killed because the server shut down.
+var errShutdown = errors.New("server shutting down")
+
+// inflight tracks the requests and go commands in progress,
+// to report those interrupted by a shutdown.
+var inflight = &inflightSet{items: make(map[uint64]string)}
+
+type inflightSet struct {
+	mu    sync.Mutex
+	next  uint64
+	items map[uint64]string
+}
+
+// add records the start of the operation described by desc
+// and returns the function recording its end.
+func (s *inflightSet) add(desc string) (done func()) {
+	s.mu.Lock()
+	id := s.next
+	s.next++
+	s.items[id] = desc
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.items, id)
+		s.mu.Unlock()
+	}
+}
+
+// list returns the operations in progress.
+func (s *inflightSet) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []string
+	for _, desc := range s.items {
+		list = append(list, desc)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// logInterrupted logs the operations still in progress
+// at the end of the drain period.
+func logInterrupted() {
+	list := inflight.list()
+	if len(list) == 0 {
+		log.Println("All in-flight requests completed.")
+		return
+	}
+	log.Printf("Drain period over, interrupting %d operations:\n", len(list))
+	for _, desc := range list {
+		log.Printf("  %s\n", desc)
+	}
+}
+
+// shutdown reports not ready for drainDelay, then shuts server down,
+// waiting up to shutdownTimeout for the requests in progress
+// before aborting them.
+func shutdown(server *http.Server) error {
+	atomic.StoreInt32(&draining, 1)
+	if drainDelay > 0 {
+		log.Printf("Reporting not ready for %v...\n", drainDelay)
+		time.Sleep(drainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		// Abort the remaining go commands and upstream requests.
+		// Cache files are written atomically, so none is left half-written.
+		logInterrupted()
+		abortInflight()
+		err = server.Close()
+	} else if err == nil {
+		logInterrupted()
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	defer func(delay, timeout time.Duration, checks string) {
+		drainDelay, shutdownTimeout, readyChecks = delay, timeout, checks
+		atomic.StoreInt32(&draining, 0)
+	}(drainDelay, shutdownTimeout, readyChecks)
+	drainDelay, shutdownTimeout, readyChecks = 500*time.Millisecond, time.Second, ""
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer public.Close()
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	get := func(u string) int {
+		t.Helper()
+		resp, err := http.Get(u)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(admin.URL + "/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz before shutdown: status %d, want %d", code, http.StatusOK)
+	}
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- shutdown(public.Config)
+	}()
+	for get(admin.URL+"/readyz") != http.StatusServiceUnavailable {
+		if time.Since(start) > drainDelay/2 {
+			t.Fatal("/readyz still ready while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The requests are still served until the drain delay is over.
+	if code := get(public.URL); code != http.StatusOK {
+		t.Errorf("request while draining: status %d, want %d", code, http.StatusOK)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if d := time.Since(start); d < drainDelay {
+		t.Errorf("shutdown after %v, want at least the drain delay %v", d, drainDelay)
+	}
+	if code := get(public.URL); code != 0 {
+		t.Errorf("request after shutdown: status %d, want a connection failure", code)
+	}
+}
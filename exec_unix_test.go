@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunContextKillsProcessGroup(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	// The shell starts a child, like the go command starting git.
+	cmd := exec.Command("sh", "-c", "sleep 100 & sleep 100")
+	setProcessGroup(cmd)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runContext(ctx, cmd)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("runContext = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("runContext still running after cancel")
+	}
+
+	// The orphaned child is reaped by init, if not already.
+	pgid := cmd.Process.Pid
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		err := syscall.Kill(-pgid, 0)
+		if err == syscall.ESRCH {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process group %d still alive after cancel: kill = %v", pgid, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
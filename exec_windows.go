@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
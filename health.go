@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/sumdb"
+)
+
+// A checkResult is the outcome of one readiness check.
+type checkResult struct {
+	Name     string  `json:"name"`
+	OK       bool    `json:"ok"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// A readiness check returns nil if the dependency it probes is usable.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// readinessChecks returns the checks run by /readyz,
+// among those enabled by the -readyChecks flag.
+func readinessChecks() []readinessCheck {
+	var all []readinessCheck
+	if serveDir == "" {
+		all = append(all, readinessCheck{"cache", checkCacheWritable}, readinessCheck{"go", checkGoCommand})
+	}
+	all = append(all, readinessCheck{"sumdb", sumdb.Check})
+	if proxyHost != "" {
+		all = append(all, readinessCheck{"upstream", checkUpstream})
+	}
+	var checks []readinessCheck
+	for _, c := range all {
+		for _, name := range strings.Split(readyChecks, ",") {
+			if strings.TrimSpace(name) == c.name {
+				checks = append(checks, c)
+				break
+			}
+		}
+	}
+	return checks
+}
+
+// healthz reports that the process is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, `{"ok":true}`)
+}
+
+// readyz runs the readiness checks concurrently within readyTimeout
+// and reports each of them, answering 503 if any failed.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	checks := readinessChecks()
+	results := make([]checkResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check(ctx)
+			results[i] = checkResult{Name: c.name, OK: err == nil, Duration: time.Since(start).Seconds()}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := struct {
+		OK       bool          `json:"ok"`
+		Draining bool          `json:"draining,omitempty"`
+		Checks   []checkResult `json:"checks"`
+	}{OK: !isDraining(), Draining: isDraining(), Checks: results}
+	for _, res := range results {
+		report.OK = report.OK && res.OK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// checkCacheWritable checks that a file can be written in downloadRoot.
+func checkCacheWritable(ctx context.Context) error {
+	if err := os.MkdirAll(downloadRoot, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(downloadRoot, ".readyz-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ok"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkGoCommand checks that the go command runs.
+func checkGoCommand(ctx context.Context) error {
+	cmd := exec.Command("go", "version")
+	setProcessGroup(cmd)
+	if err := runContext(ctx, cmd); err != nil {
+		return fmt.Errorf("go version: %v", err)
+	}
+	return nil
+}
+
+// checkUpstream checks that the upstream proxy answers.
+func checkUpstream(ctx context.Context) error {
+	return router.CheckUpstream(ctx)
+}
@@ -19,11 +19,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -35,23 +38,104 @@ import (
 
 	"github.com/goproxyio/goproxy/v2/proxy"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/mod/module"
 )
 
 var downloadRoot string
+
+// stateDir holds the files of the proxy itself, like the uploads,
+// the checksums and the module index, unless set by their flags.
+var stateDir string
 var listen, promListen string
 var cacheDir string
+var serveDir string
 var proxyHost string
 var excludeHost string
+var mergeHost string
 var cacheExpire time.Duration
+var negCacheSize int
+var negCacheTTL string
+var negCache *proxy.NegativeCache
+var listTimeout, downloadTimeout time.Duration
+var maxList, maxDownload, maxQueue int
+var listLimiter, downloadLimiter *proxy.Limiter
+var rateLimit proxy.RateLimitOptions
+var accessLogFile, accessLogFormat string
+var accessLogMaxSize, accessLogBackups int
+var cacheMetricsInterval time.Duration
+var otlpEndpoint string
+var readyTimeout time.Duration
+var readyChecks string
+var shutdownTimeout, drainDelay time.Duration
+var indexFile string
+var enableUI bool
+var uploadDir, uploadTokenFile string
+var checksumFile string
+var rewriteFile, rewriteDir string
+var vanityFile string
+var vcsPolicyFlag, vcsTimeoutFlag string
+var excludeRetracted bool
+var toolchainAllow string
+var toolchainRetention time.Duration
+var uploads *proxy.Uploads
+var router *proxy.Router
+var traceSampleRatio float64
 
 func init() {
 	flag.StringVar(&excludeHost, "exclude", "", "exclude host pattern, you can exclude internal Git services")
+	flag.StringVar(&mergeHost, "merge", "", "module path pattern whose versions are merged from the -proxy upstream and the direct source")
 	flag.StringVar(&proxyHost, "proxy", "", "next hop proxy for Go Modules, recommend use https://goproxy.io")
 	flag.StringVar(&cacheDir, "cacheDir", "", "Go Modules cache dir, default is $GOPATH/pkg/mod/cache/download")
+	flag.StringVar(&serveDir, "dir", "", "serve the module files of this directory, in GOPROXY file:// layout, instead of running the go command")
 	flag.StringVar(&listen, "listen", "0.0.0.0:8081", "service listen address")
+	flag.StringVar(&promListen, "promListen", "127.0.0.1:8082", "internal listen address for metrics, pprof and admin endpoints, empty disables it")
 	flag.DurationVar(&cacheExpire, "cacheExpire", 5*time.Minute, "Go Modules cache expiration (min), default is 5 min")
+	flag.DurationVar(&listTimeout, "listTimeout", time.Minute, "timeout of a go list command run to answer a request")
+	flag.DurationVar(&downloadTimeout, "downloadTimeout", 10*time.Minute, "timeout of a go mod download command run to answer a request")
+	flag.IntVar(&maxList, "maxList", 8, "max number of concurrent go list commands")
+	flag.IntVar(&maxDownload, "maxDownload", 16, "max number of concurrent go mod download commands")
+	flag.IntVar(&maxQueue, "maxQueue", 128, "max number of requests waiting for a go command, per kind, before answering 503")
+	flag.StringVar(&rateLimit.Key, "rateLimitKey", "ip", "client identity for rate limits: ip, user (the upload token) or header:<Name>")
+	flag.Float64Var(&rateLimit.MetaRate, "metaRate", 0, "metadata requests per second allowed per client, 0 means unlimited")
+	flag.IntVar(&rateLimit.MetaBurst, "metaBurst", 100, "metadata requests burst allowed per client")
+	flag.Float64Var(&rateLimit.ZipRate, "zipRate", 0, "zip requests per second allowed per client, 0 means unlimited")
+	flag.IntVar(&rateLimit.ZipBurst, "zipBurst", 20, "zip requests burst allowed per client")
+	flag.StringVar(&accessLogFile, "accessLog", "", "access log file, default is standard error")
+	flag.StringVar(&accessLogFormat, "accessLogFormat", "text", "access log format: text, json or logfmt")
+	flag.IntVar(&accessLogMaxSize, "accessLogMaxSize", 100, "access log file size (MB) before rotation, 0 disables rotation")
+	flag.IntVar(&accessLogBackups, "accessLogBackups", 5, "number of rotated access log files to keep")
+	flag.DurationVar(&cacheMetricsInterval, "cacheMetricsInterval", 5*time.Minute, "interval between cache size metrics updates, 0 disables them")
+	flag.StringVar(&otlpEndpoint, "otlpEndpoint", "", "OTLP/HTTP collector (host:port) to export traces to, empty disables tracing")
+	flag.Float64Var(&traceSampleRatio, "traceSampleRatio", 1, "ratio of traces sampled when the client did not decide")
+	flag.DurationVar(&readyTimeout, "readyTimeout", 3*time.Second, "time budget of the /readyz checks")
+	flag.StringVar(&readyChecks, "readyChecks", "cache,go,sumdb,upstream", "checks run by /readyz; upstream only applies with -proxy, cache and go not with -dir")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", 10*time.Second, "time given to in-flight requests to complete on shutdown")
+	flag.DurationVar(&drainDelay, "drainDelay", 0, "time to report not ready before the shutdown, so load balancers stop sending requests")
+	flag.StringVar(&uploadDir, "uploadDir", "", "directory of the module versions published with PUT, default is uploads next to the download cache, or in the user cache directory with -dir")
+	flag.StringVar(&uploadTokenFile, "uploadTokenFile", "", "file of the tokens, one per line, allowed to publish module versions with PUT; empty disables uploads")
+	flag.StringVar(&rewriteFile, "rewrite", "", "file mapping module path prefixes to git repository URLs and subdirectories, fetched directly in direct mode")
+	flag.StringVar(&rewriteDir, "rewriteDir", "", "directory of the git mirrors and zip files of the -rewrite modules, default is rewrite next to the download cache")
+	flag.StringVar(&vcsPolicyFlag, "vcs", "", "version control systems allowed per module path pattern, in GOVCS syntax, like private:git|hg,*.corp.example:svn")
+	flag.StringVar(&vcsTimeoutFlag, "vcsTimeout", "", "timeout of the direct fetches per version control system, like hg=5m,svn=20m, default is -listTimeout or -downloadTimeout")
+	flag.StringVar(&vanityFile, "vanity", "", "file mapping import path prefixes to the repositories of the go-import and go-source meta tags served for ?go-get=1")
+	flag.StringVar(&checksumFile, "checksumFile", "", "file recording the hashes of the served modules, default is checksums.sum next to the download cache, or in the user cache directory with -dir; off disables the checks")
+	flag.BoolVar(&excludeRetracted, "excludeRetracted", false, "answer @latest with the latest version not retracted by the go.mod file of the latest version; in router mode, only for the modules matched by -exclude, not the ones served by or merged with the upstream proxy")
+	flag.StringVar(&toolchainAllow, "toolchainAllow", "", "comma-separated patterns of the golang.org/toolchain versions served, like go1.22.*.linux-amd64; empty serves all")
+	flag.DurationVar(&toolchainRetention, "toolchainRetention", 0, "time a cached golang.org/toolchain version is kept after its last request, 0 keeps them forever")
+	flag.BoolVar(&enableUI, "ui", false, "serve the cache browser under /ui/")
+	flag.StringVar(&indexFile, "indexFile", "", "module index feed file, default is index.jsonl next to the download cache, or in the user cache directory with -dir")
+	flag.IntVar(&negCacheSize, "negCacheSize", 10000, "max number of remembered 404/410 responses, 0 disables negative caching")
+	flag.StringVar(&negCacheTTL, "negCacheTTL", "list=1m,latest=1m,info=1m,mod=10m,zip=10m", "negative cache expiration per artifact kind")
+}
+
+// setup parses the flags and prepares the environment of the go commands,
+// the limiters and the tables read from files.
+func setup() {
 	flag.Parse()
 
 	if os.Getenv("GIT_TERMINAL_PROMPT") == "" {
@@ -66,33 +150,217 @@ func init() {
 		os.Setenv("GOPRIVATE", excludeHost)
 	}
 
+	policy := vcsPolicyFlag
+	if policy == "" {
+		policy = os.Getenv("GOVCS")
+	} else {
+		// Let the go command enforce the same policy.
+		os.Setenv("GOVCS", policy)
+	}
+	rules, err := parseVCSPolicy(policy)
+	if err != nil {
+		log.Fatalf("invalid vcs policy %q: %v", policy, err)
+	}
+	vcsPolicy = append(rules, defaultVCSPolicy...)
+	if vcsTimeouts, err = parseKindDurations(vcsTimeoutFlag); err != nil {
+		log.Fatalf("invalid -vcsTimeout: %v", err)
+	}
+
 	// Enable Go module
 	os.Setenv("GO111MODULE", "on")
 	os.Setenv("GOPROXY", "direct")
 	os.Setenv("GOSUMDB", "off")
 
-	downloadRoot = getDownloadRoot()
+	if serveDir != "" {
+		downloadRoot = serveDir
+		// Keep the files of the proxy out of the directory served.
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatalf("-dir: %v; set -uploadDir, -checksumFile and -indexFile", err)
+		}
+		stateDir = filepath.Join(userCache, "goproxy")
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		downloadRoot = getDownloadRoot()
+		stateDir = filepath.Dir(downloadRoot)
+	}
+	listLimiter = proxy.NewLimiter("list", int64(maxList), maxQueue)
+	downloadLimiter = proxy.NewLimiter("download", int64(maxDownload), maxQueue)
+
+	if uploadDir == "" {
+		uploadDir = filepath.Join(stateDir, "uploads")
+	}
+	var tokens []string
+	if uploadTokenFile != "" {
+		var err error
+		if tokens, err = readTokens(uploadTokenFile); err != nil {
+			log.Fatalf("read upload tokens: %v", err)
+		}
+	}
+	uploads = proxy.NewUploads(uploadDir, tokens)
+	uploads.Cache = downloadRoot
+
+	if rewriteDir == "" {
+		rewriteDir = filepath.Join(stateDir, "rewrite")
+	}
+	if rewriteFile != "" {
+		var err error
+		if rewrites, err = readRewrites(rewriteFile); err != nil {
+			log.Fatalf("read rewrite table: %v", err)
+		}
+	}
+	if vanityFile != "" {
+		var err error
+		if vanity, err = readVanity(vanityFile); err != nil {
+			log.Fatalf("read vanity table: %v", err)
+		}
+	}
+}
+
+// readTokens reads the tokens listed one per line in file,
+// ignoring blank lines and lines starting with #.
+func readTokens(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no token in %s", file)
+	}
+	return tokens, nil
 }
 
 func main() {
+	setup()
 	log.SetPrefix("goproxy.io: ")
 	log.SetFlags(0)
 
+	ttl, err := parseKindDurations(negCacheTTL)
+	if err != nil {
+		log.Fatalf("invalid -negCacheTTL: %v", err)
+	}
+	negCache = proxy.NewNegativeCache(negCacheSize, ttl)
+	uploads.Published = func(m module.Version) {
+		negCache.Invalidate(m.Path)
+	}
+
+	shutdownTracing, err := setupTracing(otlpEndpoint, traceSampleRatio)
+	if err != nil {
+		log.Fatalf("tracing setup failed: %v", err)
+	}
+
+	var backends proxy.ServerOps
+	if serveDir != "" {
+		log.Printf("Serving modules from %s", serveDir)
+		backends = proxy.Chain(uploads, proxy.NewDirOps(serveDir))
+	} else if len(rewrites) > 0 {
+		backends = proxy.Chain(uploads, newVCSOps(rewriteDir), new(ops))
+	} else {
+		backends = proxy.Chain(uploads, new(ops))
+	}
+	if excludeRetracted {
+		backends = proxy.ExcludeRetracted(backends)
+	}
+	srv := proxy.NewServer(backends)
+	if checksumFile != "off" {
+		if checksumFile == "" {
+			checksumFile = filepath.Join(stateDir, "checksums.sum")
+		}
+		srv.Checksums, err = proxy.OpenChecksums(checksumFile)
+		if err != nil {
+			log.Fatalf("open checksums: %v", err)
+		}
+		defer srv.Checksums.Close()
+		uploads.Checksums = srv.Checksums
+	}
+
 	var handle http.Handler
+	status := srv.ServeStatus
 	if proxyHost != "" {
 		log.Printf("ProxyHost %s\n", proxyHost)
 		if excludeHost != "" {
 			log.Printf("ExcludeHost %s\n", excludeHost)
 		}
-		handle = &logger{proxy.NewRouter(proxy.NewServer(new(ops)), &proxy.RouterOptions{
+		router = proxy.NewRouter(srv, &proxy.RouterOptions{
 			Pattern:      excludeHost,
 			Proxy:        proxyHost,
 			DownloadRoot: downloadRoot,
 			CacheExpire:  cacheExpire,
-		})}
+			Merge:        mergeHost,
+		})
+		handle, status = router, router.ServeStatus
 	} else {
-		handle = &logger{proxy.NewServer(new(ops))}
+		handle = srv
+	}
+	if indexFile == "" {
+		indexFile = filepath.Join(stateDir, "index.jsonl")
+	}
+	index, err := proxy.OpenIndex(indexFile)
+	if err != nil {
+		log.Fatalf("open module index: %v", err)
+	}
+	defer index.Close()
+	handle = index.Handler(handle)
+	handle = negCache.Handler(handle)
+	var browser *proxy.Browser
+	if enableUI {
+		browser = proxy.NewBrowser(downloadRoot, index)
+		handle = browser.Handler(handle)
+	}
+	toolchainOpts := &proxy.ToolchainOptions{}
+	for _, pattern := range strings.Split(toolchainAllow, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatalf("invalid -toolchainAllow pattern %q: %v", pattern, err)
+			}
+			toolchainOpts.Allow = append(toolchainOpts.Allow, pattern)
+		}
+	}
+	if serveDir == "" {
+		toolchainOpts.Retention = toolchainRetention
+		toolchainOpts.ExtractDir = filepath.Dir(filepath.Dir(downloadRoot))
+	}
+	toolchains := proxy.NewToolchains(downloadRoot, toolchainOpts)
+	handle = toolchains.Handler(handle)
+	handle = withPages(handle, index, browser, status)
+	if uploadTokenFile != "" {
+		handle = uploads.Handler(handle)
+		rateLimit.Identify = uploads.Identity
+	}
+	handle = proxy.NewRateLimiter(&rateLimit).Handler(handle)
+	handle = proxy.MetricsHandler(handle)
+	var accessOut io.Writer = os.Stderr
+	if accessLogFile != "" {
+		accessOut, err = openRotatingFile(accessLogFile, int64(accessLogMaxSize)<<20, accessLogBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
+	access, err := newAccessLogger(accessOut, accessLogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handle = &logger{h: handle, access: access, identify: rateLimit.Identify}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if cacheMetricsInterval > 0 {
+		go proxy.WatchCacheSize(downloadRoot, cacheMetricsInterval, stop)
+	}
+	toolchainInterval := cacheMetricsInterval
+	if toolchainInterval <= 0 {
+		toolchainInterval = 5 * time.Minute
+	}
+	go toolchains.Watch(toolchainInterval, stop)
 
 	server := &http.Server{Addr: listen, Handler: handle}
 	go func() {
@@ -103,16 +371,34 @@ func main() {
 		}
 	}()
 
+	var adminServer *http.Server
+	if promListen != "" {
+		log.Printf("Internal endpoints on %s\n", promListen)
+		adminServer = &http.Server{Addr: promListen, Handler: adminHandler()}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil {
+				if err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
+			}
+		}()
+	}
+
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, os.Interrupt, syscall.SIGTERM)
 	<-s
 	log.Println("Making a graceful shutdown...")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	err := server.Shutdown(ctx)
-	if err != nil {
+	if err := shutdown(server); err != nil {
 		log.Fatalf("Error while shutting down the server: %v", err)
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if adminServer != nil {
+		adminServer.Shutdown(ctx)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Error while flushing traces: %v", err)
+	}
 	log.Println("Successful server shutdown.")
 }
 
@@ -124,7 +410,7 @@ func getDownloadRoot() string {
 		os.Setenv("GOMODCACHE", filepath.Join(cacheDir, "pkg", "mod"))
 		return filepath.Join(cacheDir, "pkg", "mod", "cache", "download")
 	}
-	if err := goJSON(&env, "go", "env", "-json", "GOPATH"); err != nil {
+	if err := goJSON(context.Background(), &env, "go", "env", "-json", "GOPATH"); err != nil {
 		log.Fatal(err)
 	}
 	list := filepath.SplitList(env.GOPATH)
@@ -135,27 +421,165 @@ func getDownloadRoot() string {
 	return filepath.Join(list[0], "pkg", "mod", "cache", "download")
 }
 
+var (
+	execAborted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "exec",
+		Name:      "aborted_total",
+		Help:      "go command executions killed before completion",
+	}, []string{"command", "reason"})
+	execDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "goproxy",
+		Subsystem: "exec",
+		Name:      "duration_seconds",
+		Help:      "time spent running go commands",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"command", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(execAborted, execDuration)
+}
+
 // goJSON runs the go command and parses its JSON output into dst.
-func goJSON(dst interface{}, command ...string) error {
+// The command and all processes it started are killed when ctx is done.
+func goJSON(ctx context.Context, dst interface{}, command ...string) error {
+	stdout, err := runCommand(ctx, "", command...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(stdout, dst); err != nil {
+		return fmt.Errorf("%s: reading json: %v", strings.Join(command, " "), err)
+	}
+	return nil
+}
+
+// runCommand runs command in dir and returns its standard output.
+// Failures are classified into the error kinds of package proxy.
+// The command and all processes it started are killed when ctx is done.
+func runCommand(ctx context.Context, dir string, command ...string) ([]byte, error) {
 	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = dir
+	setProcessGroup(cmd)
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%s:\n%s%s", strings.Join(command, " "), stderr.String(), stdout.String())
+	name := strings.Join(command[:2], " ")
+	ctx, span := tracer().Start(ctx, "exec "+name, trace.WithAttributes(attribute.String("exec.command", strings.Join(command, " "))))
+	defer span.End()
+	done := inflight.add("command " + strings.Join(command, " "))
+	defer done()
+	start := time.Now()
+	err := runContext(ctx, cmd)
+	status := "ok"
+	if err != nil {
+		status = "error"
+		span.SetStatus(codes.Error, err.Error())
 	}
-	if err := json.Unmarshal(stdout.Bytes(), dst); err != nil {
-		return fmt.Errorf("%s: reading json: %v", strings.Join(command, " "), err)
+	execDuration.With(prometheus.Labels{"command": name, "status": status}).Observe(time.Since(start).Seconds())
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			execAborted.With(prometheus.Labels{"command": name, "reason": "timeout"}).Inc()
+			return nil, proxy.NewError(proxy.ErrUpstreamTimeout, fmt.Errorf("%s: %v", strings.Join(command, " "), ctx.Err()))
+		case context.Canceled:
+			execAborted.With(prometheus.Labels{"command": name, "reason": "cancelled"}).Inc()
+			return nil, fmt.Errorf("%s: %v", strings.Join(command, " "), ctx.Err())
+		}
+		if err == errShutdown {
+			execAborted.With(prometheus.Labels{"command": name, "reason": "shutdown"}).Inc()
+			return nil, proxy.NewError(proxy.ErrOverloaded, fmt.Errorf("%s: %v", strings.Join(command, " "), err))
+		}
+		out := stderr.String() + stdout.String()
+		return nil, proxy.NewError(goErrorKind(out), fmt.Errorf("%s:\n%s", strings.Join(command, " "), out))
 	}
-	return nil
+	return stdout.Bytes(), nil
+}
+
+// runContext runs cmd, killing its process group if ctx is done first.
+func runContext(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return ctx.Err()
+	case <-stopCtx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return errShutdown
+	}
+}
+
+// goErrorPatterns maps substrings of go command failures to error kinds.
+// The first matching pattern wins.
+var goErrorPatterns = []struct {
+	substr string
+	kind   error
+}{
+	{"Authentication failed", proxy.ErrVCSAuth},
+	{"authorization failed", proxy.ErrVCSAuth},
+	{"Permission denied (publickey", proxy.ErrVCSAuth},
+	{"Host key verification failed", proxy.ErrVCSAuth},
+	// Git prompts for credentials when the host answers 401, because
+	// of missing or expired credentials, or because the repository does
+	// not exist on hosts like GitHub: see goFetch.
+	{"terminal prompts disabled", proxy.ErrVCSAuth},
+	{"could not read Username", proxy.ErrVCSAuth},
+	{"could not read Password", proxy.ErrVCSAuth},
+	{"i/o timeout", proxy.ErrUpstreamTimeout},
+	{"timed out", proxy.ErrUpstreamTimeout},
+	{"deadline exceeded", proxy.ErrUpstreamTimeout},
+	{"Timeout exceeded", proxy.ErrUpstreamTimeout},
+	{"disallowed by GOVCS", proxy.ErrForbidden},
+	{"GOVCS disallows", proxy.ErrForbidden},
+	{"403 Forbidden", proxy.ErrForbidden},
+	{"410 Gone", proxy.ErrGone},
+	{"invalid version", proxy.ErrInvalidVersion},
+	{"malformed module path", proxy.ErrInvalidVersion},
+	{"not a semantic version", proxy.ErrInvalidVersion},
+	{"unknown revision", proxy.ErrNotFound},
+	{"no matching versions", proxy.ErrNotFound},
+	{"Repository not found", proxy.ErrNotFound},
+	{"repository not found", proxy.ErrNotFound},
+	{"does not exist", proxy.ErrNotFound},
+	{"404 Not Found", proxy.ErrNotFound},
+	{"not found", proxy.ErrNotFound},
+	{"unrecognized import path", proxy.ErrNotFound},
+}
+
+// errGoCommand is the kind of go command failures matching no known pattern,
+// which result in a 500 error.
+var errGoCommand = errors.New("go command failed")
+
+// goErrorKind classifies the output of a failed go command.
+func goErrorKind(out string) error {
+	for _, p := range goErrorPatterns {
+		if strings.Contains(out, p.substr) {
+			return p.kind
+		}
+	}
+	return errGoCommand
 }
 
-// A logger is an http.Handler that logs traffic to standard error.
+// A logger is an http.Handler that logs traffic to the access log.
 type logger struct {
-	h http.Handler
+	h      http.Handler
+	access *accessLogger
+	// identify returns the verified identity of the client, if any.
+	identify func(*http.Request) (string, bool)
 }
 type responseLogger struct {
-	code int
+	code  int
+	bytes int64
 	http.ResponseWriter
 }
 
@@ -165,27 +589,135 @@ func (r *responseLogger) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 
+// Write writes data into responser writer, counting the bytes.
+func (r *responseLogger) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
 // ServeHTTP implements http handler.
 func (l *logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	// Prometheus metrics
-	if r.URL.Path == "/metrics" {
-		promhttp.Handler().ServeHTTP(w, r)
+	// Internal endpoints are only served by the promListen listener.
+	if isInternalPath(r.URL.Path) {
+		http.NotFound(w, r)
 		return
 	}
 
+	done := inflight.add("request " + r.Method + " " + r.URL.RequestURI())
+	defer done()
 	start := time.Now()
+	id := requestID(r)
+	w.Header().Set("X-Request-Id", id)
+	r, span := startServerSpan(r)
+	defer span.End()
+	r, info := proxy.WithRequestInfo(r)
 	rl := &responseLogger{code: 200, ResponseWriter: w}
 	l.h.ServeHTTP(rl, r)
-	log.Printf("%.3fs %d %s\n", time.Since(start).Seconds(), rl.code, r.URL)
+	span.SetAttributes(
+		attribute.Int("http.status_code", rl.code),
+		attribute.String("goproxy.request_id", id),
+		attribute.String("goproxy.mode", info.Mode),
+	)
+	l.access.log(newAccessRecord(r, info, rl, id, start, l.identify))
+}
+
+// withPages returns h wrapped so that the module index feed
+// is served at /index, the retractions and deprecation of a module
+// at /module, the cache browser, if any, under /ui/, and the meta tags
+// of the vanity and rewrite tables for ?go-get=1.
+func withPages(h http.Handler, index *proxy.Index, browser *proxy.Browser, status http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if serveGoGet(w, r) {
+			return
+		}
+		if r.URL.Path == "/index" {
+			index.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/module" {
+			status(w, r)
+			return
+		}
+		if browser != nil && (r.URL.Path == "/ui" || strings.HasPrefix(r.URL.Path, "/ui/")) {
+			browser.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// internalPaths lists the path prefixes served only by the internal listener.
+var internalPaths = []string{"/metrics", "/debug/", "/admin/", "/healthz", "/readyz"}
+
+// isInternalPath reports whether p is served only by the internal listener.
+func isInternalPath(p string) bool {
+	for _, prefix := range internalPaths {
+		if p == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(p, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminHandler returns the handler of the internal listener.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/admin/negcache", invalidateNegCache)
+	return mux
+}
+
+// invalidateNegCache drops the remembered 404/410 responses
+// of the module given by the "module" query parameter, or all of them.
+func invalidateNegCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := negCache.Invalidate(r.URL.Query().Get("module"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%d entries invalidated\n", n)
+}
+
+// parseKindDurations parses a comma-separated list of kind=duration pairs.
+func parseKindDurations(s string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("missing '=' in %q", kv)
+		}
+		d, err := time.ParseDuration(kv[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		m[strings.TrimSpace(kv[:i])] = d
+	}
+	return m, nil
 }
 
 // An ops is a proxy.ServerOps implementation.
 type ops struct{}
 
-// NewContext creates a context.
+// NewContext returns the request context,
+// which is cancelled when the client goes away.
 func (*ops) NewContext(r *http.Request) (context.Context, error) {
-	return context.Background(), nil
+	return r.Context(), nil
 }
 
 // List lists proxy files.
@@ -202,11 +734,16 @@ func (*ops) List(ctx context.Context, mpath string) (proxy.File, error) {
 		Path     string
 		Versions []string
 	}
-	if err := goJSON(&list, "go", "list", "-m", "-json", "-versions", mpath+"@latest"); err != nil {
+	release, err := listLimiter.Acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := goFetch(ctx, mpath, listTimeout, &list, "go", "list", "-m", "-json", "-versions", mpath+"@latest"); err != nil {
 		return nil, err
 	}
 	if list.Path != mpath {
-		return nil, fmt.Errorf("go list -m: asked for %s but got %s", mpath, list.Path)
+		return nil, proxy.NewError(proxy.ErrNotFound, fmt.Errorf("go list -m: asked for %s but got %s", mpath, list.Path))
 	}
 	data := []byte(strings.Join(list.Versions, "\n") + "\n")
 	if len(data) == 1 {
@@ -226,7 +763,7 @@ func (*ops) List(ctx context.Context, mpath string) (proxy.File, error) {
 
 // Latest fetches latest file.
 func (*ops) Latest(ctx context.Context, path string) (proxy.File, error) {
-	d, err := download(module.Version{Path: path, Version: "latest"})
+	d, err := download(ctx, module.Version{Path: path, Version: "latest"})
 	if err != nil {
 		return nil, err
 	}
@@ -235,7 +772,7 @@ func (*ops) Latest(ctx context.Context, path string) (proxy.File, error) {
 
 // Info fetches info file.
 func (*ops) Info(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := download(ctx, m)
 	if err != nil {
 		return nil, err
 	}
@@ -244,7 +781,7 @@ func (*ops) Info(ctx context.Context, m module.Version) (proxy.File, error) {
 
 // GoMod fetches go mod file.
 func (*ops) GoMod(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := download(ctx, m)
 	if err != nil {
 		return nil, err
 	}
@@ -253,7 +790,7 @@ func (*ops) GoMod(ctx context.Context, m module.Version) (proxy.File, error) {
 
 // Zip fetches zip file.
 func (*ops) Zip(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := download(ctx, m)
 	if err != nil {
 		return nil, err
 	}
@@ -271,7 +808,12 @@ type downloadInfo struct {
 	GoModSum string
 }
 
-func download(m module.Version) (*downloadInfo, error) {
+func download(ctx context.Context, m module.Version) (*downloadInfo, error) {
+	release, err := downloadLimiter.Acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	d := new(downloadInfo)
-	return d, goJSON(d, "go", "mod", "download", "-json", m.String())
+	return d, goFetch(ctx, m.Path, downloadTimeout, d, "go", "mod", "download", "-json", m.String())
 }
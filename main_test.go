@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+)
+
+func TestGoErrorKind(t *testing.T) {
+	tests := []struct {
+		out  string
+		kind error
+	}{
+		{"go: module github.com/x/typo: git ls-remote -q origin in /tmp: exit status 128:\n" +
+			"\tfatal: could not read Username for 'https://github.com': terminal prompts disabled\n" +
+			"Confirm the import path was typed correctly.", proxy.ErrVCSAuth},
+		{"remote: HTTP Basic: Access denied\nfatal: Authentication failed for 'https://gitlab.corp.example/x.git/'", proxy.ErrVCSAuth},
+		{"git@github.com: Permission denied (publickey).", proxy.ErrVCSAuth},
+		{"dial tcp 10.0.0.1:443: i/o timeout", proxy.ErrUpstreamTimeout},
+		{"go: github.com/x/y@latest: GOVCS disallows using git for public github.com/x/y; see 'go help vcs'", proxy.ErrForbidden},
+		{"reading https://example.com/x/@v/list: 410 Gone", proxy.ErrGone},
+		{"go: example.com/m@v1.x: invalid version: unknown revision v1.x", proxy.ErrInvalidVersion},
+		{"go: example.com/m@v1.9.0: unknown revision v1.9.0", proxy.ErrNotFound},
+		{"go: module example.com/m: no matching versions for query \"latest\"", proxy.ErrNotFound},
+		{"go: unrecognized import path \"example.com/m\"", proxy.ErrNotFound},
+		{"go: something unexpected", errGoCommand},
+	}
+	for _, tt := range tests {
+		if kind := goErrorKind(tt.out); !errors.Is(kind, tt.kind) {
+			t.Errorf("goErrorKind(%q) = %v, want %v", tt.out, kind, tt.kind)
+		}
+	}
+}
+
+func TestInternalPathsRefused(t *testing.T) {
+	access, err := newAccessLogger(ioutil.Discard, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := &logger{h: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("public"))
+	}), access: access}
+	admin := adminHandler()
+	for _, tt := range []struct {
+		path     string
+		internal bool
+	}{
+		{"/metrics", true},
+		{"/debug/pprof/", true},
+		{"/debug/pprof/heap", true},
+		{"/admin/negcache", true},
+		{"/healthz", true},
+		{"/readyz", true},
+		{"/example.com/admin/@v/list", false},
+		{"/metrics.example/m/@v/list", false},
+	} {
+		rec := httptest.NewRecorder()
+		public.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if served := rec.Body.String() == "public"; served == tt.internal {
+			t.Errorf("public handler, GET %s: status %d, served %v, want %v", tt.path, rec.Code, served, !tt.internal)
+		}
+		if tt.internal && rec.Code != http.StatusNotFound {
+			t.Errorf("public handler, GET %s: status %d, want %d", tt.path, rec.Code, http.StatusNotFound)
+		}
+	}
+	// The internal listener serves them.
+	for _, p := range []string{"/metrics", "/debug/pprof/", "/healthz"} {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("internal handler, GET %s: status %d, want %d", p, rec.Code, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package proxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// maxBrowseModules bounds the number of modules listed by a search.
+const maxBrowseModules = 500
+
+// maxLastAccess bounds the number of module versions whose last access
+// is remembered, the least recently accessed being forgotten first.
+const maxLastAccess = 100000
+
+// A Browser is an http.Handler serving HTML pages
+// about the modules in a download cache:
+//
+//	/ui/?prefix=golang.org/x/      modules whose path has the prefix
+//	/ui/mod?path=golang.org/x/text versions of a module
+//	/ui/mod?path=...&version=...   go.mod file of a module version
+//
+// Browser.Handler records the last successful access to each module
+// version since the process started; the first access is taken from
+// the Index, if any.
+type Browser struct {
+	root  string
+	index *Index
+
+	mu         sync.Mutex
+	lru        *list.List
+	lastAccess map[module.Version]*list.Element
+}
+
+type browseAccess struct {
+	m    module.Version
+	time time.Time
+}
+
+// NewBrowser returns a Browser for the download cache at root.
+// The index may be nil.
+func NewBrowser(root string, index *Index) *Browser {
+	return &Browser{
+		root:       root,
+		index:      index,
+		lru:        list.New(),
+		lastAccess: make(map[module.Version]*list.Element),
+	}
+}
+
+// Handler returns h wrapped so that the successful accesses
+// to module versions are recorded.
+func (b *Browser) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mod, vers, kind := parseRequestPath(r.URL.Path)
+		if kind != KindMod && kind != KindZip && kind != KindInfo {
+			h.ServeHTTP(w, r)
+			return
+		}
+		mw := NewMetricsResponseWriter(w)
+		h.ServeHTTP(mw, r)
+		if mw.statusCode == 0 || mw.statusCode/100 == 2 {
+			b.access(module.Version{Path: mod, Version: vers})
+		}
+	})
+}
+
+// access records an access to m.
+func (b *Browser) access(m module.Version) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if el, ok := b.lastAccess[m]; ok {
+		el.Value.(*browseAccess).time = time.Now()
+		b.lru.MoveToFront(el)
+		return
+	}
+	b.lastAccess[m] = b.lru.PushFront(&browseAccess{m, time.Now()})
+	for b.lru.Len() > maxLastAccess {
+		el := b.lru.Back()
+		b.lru.Remove(el)
+		delete(b.lastAccess, el.Value.(*browseAccess).m)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (b *Browser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/ui") {
+	case "", "/":
+		b.serveModules(w, r)
+	case "/mod":
+		if r.URL.Query().Get("version") != "" {
+			b.serveGoMod(w, r)
+		} else {
+			b.serveVersions(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveModules lists the cached modules matching the prefix parameter.
+func (b *Browser) serveModules(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	mods, truncated, err := b.modules(prefix)
+	if err != nil {
+		log.Printf("browse: %v", err)
+		http.Error(w, "cannot list the cached modules", http.StatusInternalServerError)
+		return
+	}
+	b.render(w, modulesTmpl, map[string]interface{}{
+		"Prefix":    prefix,
+		"Modules":   mods,
+		"Truncated": truncated,
+	})
+}
+
+// modules returns the paths of the cached modules beginning with prefix.
+func (b *Browser) modules(prefix string) (mods []string, truncated bool, err error) {
+	// Only walk the directory holding the prefix, if it has a module path.
+	dir := b.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		if esc, err := module.EscapePath(prefix[:i]); err == nil {
+			dir = filepath.Join(b.root, filepath.FromSlash(esc))
+		}
+	}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				// No module cached under the prefix.
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || p == b.root {
+			return nil
+		}
+		if info.Name() == "sumdb" && filepath.Dir(p) == b.root {
+			return filepath.SkipDir
+		}
+		if info.Name() != "@v" {
+			// Prune the directories out of the prefix. Some hold no
+			// valid module path, like gopkg.in/user: walk them.
+			rel, err := filepath.Rel(b.root, p)
+			if err != nil {
+				return filepath.SkipDir
+			}
+			mod, err := module.UnescapePath(filepath.ToSlash(rel))
+			if err == nil && !strings.HasPrefix(mod, prefix) && !strings.HasPrefix(prefix, mod+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, filepath.Dir(p))
+		if err != nil {
+			return filepath.SkipDir
+		}
+		mod, err := module.UnescapePath(filepath.ToSlash(rel))
+		if err != nil || !strings.HasPrefix(mod, prefix) {
+			return filepath.SkipDir
+		}
+		if len(mods) == maxBrowseModules {
+			truncated = true
+			return filepath.SkipAll
+		}
+		mods = append(mods, mod)
+		return filepath.SkipDir
+	})
+	sort.Strings(mods)
+	return mods, truncated, err
+}
+
+// A browseVersion describes a cached module version.
+type browseVersion struct {
+	Version     string
+	Time        time.Time
+	ZipSize     int64
+	HasMod      bool
+	FirstAccess time.Time
+	LastAccess  time.Time
+}
+
+// serveVersions lists the cached versions of the module given by the path parameter.
+func (b *Browser) serveVersions(w http.ResponseWriter, r *http.Request) {
+	mod := r.URL.Query().Get("path")
+	dir, err := b.versionDir(mod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		http.Error(w, "module not cached", http.StatusNotFound)
+		return
+	}
+	byVersion := make(map[string]*browseVersion)
+	for _, fi := range files {
+		ext := path.Ext(fi.Name())
+		if ext != ".info" && ext != ".mod" && ext != ".zip" {
+			continue
+		}
+		vers, err := module.UnescapeVersion(strings.TrimSuffix(fi.Name(), ext))
+		if err != nil || vers != module.CanonicalVersion(vers) {
+			continue
+		}
+		v := byVersion[vers]
+		if v == nil {
+			v = &browseVersion{Version: vers}
+			byVersion[vers] = v
+		}
+		switch ext {
+		case ".info":
+			var info struct{ Time time.Time }
+			if data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name())); err == nil && json.Unmarshal(data, &info) == nil {
+				v.Time = info.Time
+			}
+		case ".mod":
+			v.HasMod = true
+		case ".zip":
+			v.ZipSize = fi.Size()
+		}
+	}
+	var versions []*browseVersion
+	b.mu.Lock()
+	for _, v := range byVersion {
+		m := module.Version{Path: mod, Version: v.Version}
+		if el, ok := b.lastAccess[m]; ok {
+			v.LastAccess = el.Value.(*browseAccess).time
+		}
+		if b.index != nil {
+			v.FirstAccess, _ = b.index.First(m)
+		}
+		versions = append(versions, v)
+	}
+	b.mu.Unlock()
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i].Version, versions[j].Version) > 0
+	})
+	b.render(w, versionsTmpl, map[string]interface{}{
+		"Path":     mod,
+		"Versions": versions,
+	})
+}
+
+// serveGoMod shows the go.mod file of a cached module version.
+func (b *Browser) serveGoMod(w http.ResponseWriter, r *http.Request) {
+	mod, vers := r.URL.Query().Get("path"), r.URL.Query().Get("version")
+	dir, err := b.versionDir(mod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	escVers, err := module.EscapeVersion(vers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, escVers+".mod"))
+	if err != nil {
+		http.Error(w, "go.mod not cached", http.StatusNotFound)
+		return
+	}
+	b.render(w, goModTmpl, map[string]interface{}{
+		"Path":    mod,
+		"Version": vers,
+		"GoMod":   string(data),
+	})
+}
+
+// versionDir returns the @v directory of the module mod.
+func (b *Browser) versionDir(mod string) (string, error) {
+	esc, err := module.EscapePath(mod)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(b.root, filepath.FromSlash(esc), "@v"), nil
+}
+
+func (b *Browser) render(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("browse: %v", err)
+	}
+}
+
+var browseFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format("2006-01-02 15:04:05")
+	},
+	"size": func(n int64) string {
+		switch {
+		case n == 0:
+			return "-"
+		case n < 1<<10:
+			return strconv.FormatInt(n, 10) + " B"
+		case n < 1<<20:
+			return strconv.FormatInt(n>>10, 10) + " KB"
+		}
+		return strconv.FormatInt(n>>20, 10) + " MB"
+	},
+}
+
+const browseHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>goproxy{{with .Path}} - {{.}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+pre { background: #f6f6f6; padding: 1em; }
+</style>
+</head>
+<body>
+<h1><a href="/ui/">goproxy</a></h1>
+<form action="/ui/"><input name="prefix" size="60" placeholder="module path prefix" value="{{.Prefix}}"> <input type="submit" value="Search"></form>
+`
+
+var modulesTmpl = template.Must(template.New("modules").Funcs(browseFuncs).Parse(browseHeader + `
+<h2>Cached modules</h2>
+<ul>
+{{range .Modules}}<li><a href="/ui/mod?path={{.}}">{{.}}</a></li>
+{{else}}<li>No cached module matches.</li>
+{{end}}</ul>
+{{if .Truncated}}<p>Only the first modules are listed; refine the search.</p>{{end}}
+</body>
+</html>
+`))
+
+var versionsTmpl = template.Must(template.New("versions").Funcs(browseFuncs).Parse(browseHeader + `
+<h2>{{.Path}}</h2>
+<table>
+<tr><th>Version</th><th>Published</th><th>Zip size</th><th>First access</th><th>Last access</th><th></th></tr>
+{{range .Versions}}<tr>
+<td>{{.Version}}</td><td>{{date .Time}}</td><td>{{size .ZipSize}}</td><td>{{date .FirstAccess}}</td><td>{{date .LastAccess}}</td>
+<td>{{if .HasMod}}<a href="/ui/mod?path={{$.Path}}&amp;version={{.Version}}">go.mod</a>{{end}}</td>
+</tr>
+{{end}}</table>
+<p>Last access is tracked since the proxy started.</p>
+</body>
+</html>
+`))
+
+var goModTmpl = template.Must(template.New("gomod").Funcs(browseFuncs).Parse(browseHeader + `
+<h2><a href="/ui/mod?path={{.Path}}">{{.Path}}</a> {{.Version}}</h2>
+<pre>{{.GoMod}}</pre>
+</body>
+</html>
+`))
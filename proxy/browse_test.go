@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+func TestBrowser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-browse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"example.com/!foo/bar/@v/v1.2.0.info": `{"Version":"v1.2.0","Time":"2020-03-04T05:06:07Z"}`,
+		"example.com/!foo/bar/@v/v1.2.0.mod":  "module example.com/Foo/bar\n",
+		"example.com/!foo/bar/@v/v1.2.0.zip":  strings.Repeat("x", 2048),
+		"other.org/m/@v/v0.1.0.mod":           "module other.org/m\n",
+		"sumdb/sum.golang.org/@v/v0.0.0.mod":  "",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewBrowser(dir, nil)
+	get := func(u string) string {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", u, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	if body := get("/ui/"); !strings.Contains(body, ">example.com/Foo/bar<") || !strings.Contains(body, ">other.org/m<") || strings.Contains(body, "sumdb") {
+		t.Errorf("module list:\n%s", body)
+	}
+	if body := get("/ui/?prefix=example.com/F"); !strings.Contains(body, ">example.com/Foo/bar<") || strings.Contains(body, ">other.org/m<") {
+		t.Errorf("module search:\n%s", body)
+	}
+	body := get("/ui/mod?path=example.com/Foo/bar")
+	for _, want := range []string{"v1.2.0", "2020-03-04 05:06:07", "2 KB"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("version list missing %q:\n%s", want, body)
+		}
+	}
+	if body := get("/ui/mod?path=example.com/Foo/bar&version=v1.2.0"); !strings.Contains(body, "module example.com/Foo/bar") {
+		t.Errorf("go.mod page:\n%s", body)
+	}
+}
+
+func TestBrowserLastAccess(t *testing.T) {
+	b := NewBrowser("", nil)
+	h := b.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "missing") {
+			http.NotFound(w, r)
+		}
+	}))
+	for _, p := range []string{"/example.com/m/@v/v1.0.0.info", "/example.com/missing/@v/v1.0.0.info", "/example.com/m/@v/list"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+	if _, ok := b.lastAccess[module.Version{Path: "example.com/m", Version: "v1.0.0"}]; !ok {
+		t.Error("successful access not recorded")
+	}
+	if len(b.lastAccess) != 1 {
+		t.Errorf("got %d accesses recorded, want 1", len(b.lastAccess))
+	}
+
+	for i := 0; i <= maxLastAccess; i++ {
+		b.access(module.Version{Path: "example.com/m", Version: fmt.Sprintf("v1.0.%d", i+1)})
+	}
+	if len(b.lastAccess) != maxLastAccess || b.lru.Len() != maxLastAccess {
+		t.Errorf("got %d accesses recorded, want %d", len(b.lastAccess), maxLastAccess)
+	}
+	if _, ok := b.lastAccess[module.Version{Path: "example.com/m", Version: "v1.0.1"}]; ok {
+		t.Error("least recently accessed version not forgotten")
+	}
+}
+
+func TestBrowserModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-browse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"example.com/!foo/bar/@v/list",
+		"example.com/foobar/x/@v/list",
+		"example.com/other/@v/list",
+		"gopkg.in/user/pkg.v3/@v/list",
+		"other.org/m/@v/list",
+		"bad.example/f",
+	} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewBrowser(dir, nil)
+	for _, tt := range []struct {
+		prefix string
+		want   string
+	}{
+		{"", "example.com/Foo/bar example.com/foobar/x example.com/other gopkg.in/user/pkg.v3 other.org/m"},
+		{"example.com/", "example.com/Foo/bar example.com/foobar/x example.com/other"},
+		{"example.com/foo", "example.com/foobar/x"},
+		{"example.com/Foo/bar", "example.com/Foo/bar"},
+		{"example.com/Foo/bar/sub", ""},
+		// gopkg.in/user is not a module path, but may hold modules.
+		{"gopkg.in/user/pkg", "gopkg.in/user/pkg.v3"},
+		{"missing.example/m", ""},
+		{"<script>/x", ""},
+	} {
+		mods, truncated, err := b.modules(tt.prefix)
+		if got := strings.Join(mods, " "); err != nil || truncated || got != tt.want {
+			t.Errorf("modules(%q) = %q, %v, %v, want %q", tt.prefix, got, truncated, err, tt.want)
+		}
+	}
+
+	// Walk errors are reported.
+	if mods, _, err := b.modules("bad.example/f/x/y"); err == nil {
+		t.Errorf("modules through a file = %q, want an error", mods)
+	}
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ui/?prefix=bad.example/f/x/y", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("listing through a file: status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
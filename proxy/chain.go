@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Chain returns a ServerOps trying the backends ops in order
+// for each artifact, like a local directory, then an object store,
+// then the go command. A backend failing with an error satisfying
+// errors.Is(err, os.ErrNotExist) or of kind ErrInvalidVersion falls
+// through to the next one; any other error is returned.
+//
+// List merges the versions listed by all the backends, in semantic
+// version order, and Latest returns the latest of the versions
+// reported by all the backends. Backends failing to list a module
+// or to report its latest version are skipped when others have it.
+// Every backend is queried for List and Latest, however slow.
+func Chain(ops ...ServerOps) ServerOps {
+	return chainOps(ops)
+}
+
+type chainOps []ServerOps
+
+type chainContextKey struct{}
+
+// NewContext returns a context carrying the contexts of all the backends.
+func (c chainOps) NewContext(r *http.Request) (context.Context, error) {
+	ctxs := make([]context.Context, len(c))
+	for i, ops := range c {
+		ctx, err := ops.NewContext(r)
+		if err != nil {
+			return nil, err
+		}
+		ctxs[i] = ctx
+	}
+	return context.WithValue(r.Context(), chainContextKey{}, ctxs), nil
+}
+
+// context returns the context of the i'th backend.
+func (c chainOps) context(ctx context.Context, i int) context.Context {
+	if ctxs, ok := ctx.Value(chainContextKey{}).([]context.Context); ok && len(ctxs) == len(c) {
+		return ctxs[i]
+	}
+	return ctx
+}
+
+// first returns the file opened by the first backend having it.
+func (c chainOps) first(ctx context.Context, open func(ops ServerOps, ctx context.Context) (File, error)) (File, error) {
+	err := error(NewError(ErrNotFound, errors.New("no backend")))
+	for i, ops := range c {
+		var f File
+		f, err = open(ops, c.context(ctx, i))
+		if err == nil || !missing(err) {
+			return f, err
+		}
+	}
+	return nil, err
+}
+
+// missing reports whether err means that a backend does not have
+// the module or version, so that the next backends are tried.
+func missing(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrInvalidVersion)
+}
+
+// List merges the version lists of all the backends.
+func (c chainOps) List(ctx context.Context, path string) (File, error) {
+	var versions []string
+	var modTime time.Time
+	found := false
+	var notFound, failed error
+	for i, ops := range c {
+		f, err := ops.List(c.context(ctx, i), path)
+		if err == nil {
+			var data []byte
+			var info os.FileInfo
+			data, err = ioutil.ReadAll(f)
+			if err == nil {
+				info, err = f.Stat()
+			}
+			f.Close()
+			if err == nil {
+				found = true
+				versions = append(versions, strings.Fields(string(data))...)
+				if info.ModTime().After(modTime) {
+					modTime = info.ModTime()
+				}
+				continue
+			}
+		}
+		if missing(err) {
+			notFound = err
+		} else if failed == nil {
+			failed = err
+		}
+	}
+	if !found {
+		if failed != nil {
+			return nil, failed
+		}
+		if notFound == nil {
+			notFound = NewError(ErrNotFound, fmt.Errorf("%s: no backend", path))
+		}
+		return nil, notFound
+	}
+	if failed != nil {
+		log.Printf("list %s: %v; serving the versions of the other backends", path, failed)
+	}
+	return MemFile(mergeVersions(versions), modTime), nil
+}
+
+// mergeVersions returns the list file of versions,
+// sorted in semantic version order and deduplicated.
+func mergeVersions(versions []string) []byte {
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+	var buf bytes.Buffer
+	for i, v := range versions {
+		if i == 0 || v != versions[i-1] {
+			fmt.Fprintln(&buf, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Latest returns the info file of the latest of the versions
+// reported by the backends, preferring releases to pre-releases
+// and pre-releases to pseudo-versions, like the go command.
+func (c chainOps) Latest(ctx context.Context, path string) (File, error) {
+	var latest File
+	var latestVers string
+	var notFound, failed error
+	for i, ops := range c {
+		f, err := ops.Latest(c.context(ctx, i), path)
+		var v string
+		if err == nil {
+			if v, err = infoVersion(f); err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			if missing(err) {
+				notFound = err
+			} else if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		if latest == nil || (v != latestVers && latestVersion([]string{latestVers, v}) == v) {
+			if latest != nil {
+				latest.Close()
+			}
+			latest, latestVers = f, v
+		} else {
+			f.Close()
+		}
+	}
+	if latest == nil {
+		if failed != nil {
+			return nil, failed
+		}
+		if notFound == nil {
+			notFound = NewError(ErrNotFound, fmt.Errorf("%s: no backend", path))
+		}
+		return nil, notFound
+	}
+	if failed != nil {
+		log.Printf("latest %s: %v; serving the latest version of the other backends", path, failed)
+	}
+	return latest, nil
+}
+
+// Info returns the info file of the first backend having m.
+func (c chainOps) Info(ctx context.Context, m module.Version) (File, error) {
+	return c.first(ctx, func(ops ServerOps, ctx context.Context) (File, error) {
+		return ops.Info(ctx, m)
+	})
+}
+
+// GoMod returns the go.mod file of the first backend having m.
+func (c chainOps) GoMod(ctx context.Context, m module.Version) (File, error) {
+	return c.first(ctx, func(ops ServerOps, ctx context.Context) (File, error) {
+		return ops.GoMod(ctx, m)
+	})
+}
+
+// Zip returns the zip file of the first backend having m.
+func (c chainOps) Zip(ctx context.Context, m module.Version) (File, error) {
+	return c.first(ctx, func(ops ServerOps, ctx context.Context) (File, error) {
+		return ops.Zip(ctx, m)
+	})
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// A fakeOps serves the versions it knows, with their go.mod files.
+type fakeOps struct {
+	name     string
+	versions []string
+	err      error // returned instead of ErrNotFound for unknown modules
+}
+
+func (o *fakeOps) NewContext(r *http.Request) (context.Context, error) {
+	return context.WithValue(r.Context(), o, o.name), nil
+}
+
+func (o *fakeOps) missing(ctx context.Context, what string) error {
+	if ctx.Value(o) != o.name {
+		return errors.New("wrong context")
+	}
+	if o.err != nil {
+		return o.err
+	}
+	return NewError(ErrNotFound, errors.New(o.name+": no "+what))
+}
+
+func (o *fakeOps) List(ctx context.Context, path string) (File, error) {
+	if path != "example.com/m" {
+		return nil, o.missing(ctx, path)
+	}
+	return MemFile([]byte(strings.Join(o.versions, "\n")+"\n"), time.Now()), nil
+}
+
+func (o *fakeOps) Latest(ctx context.Context, path string) (File, error) {
+	if path != "example.com/m" || len(o.versions) == 0 {
+		return nil, o.missing(ctx, path)
+	}
+	return NewInfo(o.versions[len(o.versions)-1], time.Now()), nil
+}
+
+func (o *fakeOps) Info(ctx context.Context, m module.Version) (File, error) {
+	return o.GoMod(ctx, m)
+}
+
+func (o *fakeOps) GoMod(ctx context.Context, m module.Version) (File, error) {
+	for _, v := range o.versions {
+		if m.Path == "example.com/m" && v == m.Version {
+			return MemFile([]byte("// "+o.name+"\n"), time.Now()), nil
+		}
+	}
+	return nil, o.missing(ctx, m.String())
+}
+
+func (o *fakeOps) Zip(ctx context.Context, m module.Version) (File, error) {
+	return o.GoMod(ctx, m)
+}
+
+func TestChain(t *testing.T) {
+	dir := &fakeOps{name: "dir", versions: []string{"v1.0.0", "v1.2.0"}}
+	store := &fakeOps{name: "store", versions: []string{"v1.10.0", "v1.0.0", "v1.1.0"}}
+	direct := &fakeOps{name: "direct", err: NewError(ErrVCSAuth, errors.New("denied"))}
+	srv := NewServer(Chain(dir, store, direct))
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/example.com/m/@v/list", 200, "v1.0.0\nv1.1.0\nv1.2.0\nv1.10.0\n"},
+		{"/example.com/m/@latest", 200, `"Version":"v1.2.0"`},
+		{"/example.com/m/@v/v1.0.0.mod", 200, "// dir\n"},
+		{"/example.com/m/@v/v1.10.0.mod", 200, "// store\n"},
+		{"/example.com/m/@v/v1.10.0.zip", 200, "// store\n"},
+		// Errors other than not found stop the chain.
+		{"/example.com/m/@v/v2.0.0.mod", 502, ""},
+		{"/example.com/other/@v/list", 502, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("GET %s: %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.code, tt.body)
+		}
+	}
+
+	direct.err = nil
+	c := Chain(dir, direct)
+	ctx, err := c.NewContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Zip(ctx, module.Version{Path: "example.com/m", Version: "v2.0.0"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Zip of a missing version: %v, want not found", err)
+	}
+	f, err := c.List(ctx, "example.com/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "v1.0.0\nv1.2.0\n" {
+		t.Errorf("List = %q", data)
+	}
+}
+
+func TestChainLatest(t *testing.T) {
+	uploads := &fakeOps{name: "uploads", versions: []string{"v1.0.0"}}
+	direct := &fakeOps{name: "direct", versions: []string{"v1.0.0", "v1.5.0"}}
+	pseudo := &fakeOps{name: "pseudo", versions: []string{"v1.6.0-0.20200101000000-abcdefabcdef"}}
+	invalid := &fakeOps{name: "invalid", err: NewError(ErrInvalidVersion, errors.New("bad"))}
+	failing := &fakeOps{name: "failing", err: NewError(ErrVCSAuth, errors.New("denied"))}
+
+	tests := []struct {
+		ops  []ServerOps
+		want string
+		code int
+	}{
+		// A version uploaded first does not hide later ones.
+		{[]ServerOps{uploads, direct}, "v1.5.0", 200},
+		{[]ServerOps{direct, uploads}, "v1.5.0", 200},
+		// Releases win over higher pseudo-versions.
+		{[]ServerOps{pseudo, uploads}, "v1.0.0", 200},
+		{[]ServerOps{pseudo}, "v1.6.0-0.20200101000000-abcdefabcdef", 200},
+		// Invalid versions fall through, other errors are skipped
+		// when another backend has the module.
+		{[]ServerOps{invalid, uploads}, "v1.0.0", 200},
+		{[]ServerOps{uploads, failing}, "v1.0.0", 200},
+		{[]ServerOps{invalid}, "", 404},
+		{[]ServerOps{invalid, failing}, "", 502},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		NewServer(Chain(tt.ops...)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/m/@latest", nil))
+		if rec.Code != tt.code || (tt.code == 200 && !strings.Contains(rec.Body.String(), `"Version":"`+tt.want+`"`)) {
+			var names []string
+			for _, ops := range tt.ops {
+				names = append(names, ops.(*fakeOps).name)
+			}
+			t.Errorf("Chain(%s) @latest: %d %q, want %d %s", strings.Join(names, ", "), rec.Code, rec.Body.String(), tt.code, tt.want)
+		}
+	}
+
+	// Invalid versions fall through for the other artifacts too.
+	c := Chain(invalid, direct)
+	ctx, err := c.NewContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GoMod(ctx, module.Version{Path: "example.com/m", Version: "v1.5.0"}); err != nil {
+		t.Errorf("GoMod after an invalid version: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// Checksums records the h1: hash of the zip file and of the go.mod
+// file of each module version the first time they are served, and
+// refuses to serve or cache different contents later on, which
+// protects the clients from tags moved upstream and from tampered
+// cache files.
+//
+// The hashes are persisted in a file in the go.sum format.
+type Checksums struct {
+	mu   sync.Mutex
+	f    *os.File
+	sums map[string]string // go.sum key, like "example.com/m v1.0.0/go.mod"
+
+	// checked remembers the files verified already,
+	// so that unchanged zip files are not hashed again.
+	checked map[string]fileStamp
+}
+
+// A fileStamp identifies the contents of a file verified by Checksums.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// OpenChecksums opens the checksums stored in file, creating it if needed.
+func OpenChecksums(file string) (*Checksums, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checksums{f: f, sums: make(map[string]string), checked: make(map[string]fileStamp)}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			// Skip a line truncated by a crash.
+			continue
+		}
+		c.sums[fields[0]+" "+fields[1]] = fields[2]
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading checksums %s: %v", file, err)
+	}
+	return c, nil
+}
+
+// Close closes the checksums file.
+func (c *Checksums) Close() error {
+	return c.f.Close()
+}
+
+// sumKey returns the go.sum key of the file of kind KindMod or KindZip of m.
+func sumKey(m module.Version, kind string) string {
+	if kind == KindMod {
+		return m.Path + " " + m.Version + "/go.mod"
+	}
+	return m.Path + " " + m.Version
+}
+
+// Verify checks the file f of kind KindMod or KindZip of m against
+// the recorded hash, recording it if there is none yet.
+// A mismatch is reported as an ErrChecksumMismatch error.
+// Verify leaves f positioned at its start.
+func (c *Checksums) Verify(m module.Version, kind string, f File) error {
+	key := sumKey(m, kind)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	stamp := fileStamp{info.Size(), info.ModTime()}
+	c.mu.Lock()
+	ok := !stamp.modTime.IsZero() && c.checked[key] == stamp
+	c.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	var sum string
+	if kind == KindZip {
+		ra, isReaderAt := f.(io.ReaderAt)
+		if !isReaderAt {
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			ra = bytes.NewReader(data)
+		}
+		sum, err = hashZip(ra, info.Size())
+	} else {
+		var data []byte
+		if data, err = ioutil.ReadAll(f); err == nil {
+			sum, err = hashGoMod(data)
+		}
+	}
+	if _, serr := f.Seek(0, io.SeekStart); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.check(key, kind, "read", sum); err != nil {
+		return err
+	}
+	if !stamp.modTime.IsZero() {
+		c.mu.Lock()
+		c.checked[key] = stamp
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// VerifyData is like Verify for the contents of a file about to be cached.
+func (c *Checksums) VerifyData(m module.Version, kind string, data []byte) error {
+	var sum string
+	var err error
+	if kind == KindZip {
+		sum, err = hashZip(bytes.NewReader(data), int64(len(data)))
+	} else {
+		sum, err = hashGoMod(data)
+	}
+	if err != nil {
+		return err
+	}
+	return c.check(sumKey(m, kind), kind, "write", sum)
+}
+
+// Recorded reports whether a hash of the zip file
+// or of the go.mod file of m is recorded.
+func (c *Checksums) Recorded(m module.Version) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, zipOK := c.sums[sumKey(m, KindZip)]
+	_, modOK := c.sums[sumKey(m, KindMod)]
+	return zipOK || modOK
+}
+
+// check compares sum with the hash recorded under key,
+// recording it if there is none yet.
+func (c *Checksums) check(key, kind, op, sum string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	recorded, ok := c.sums[key]
+	if !ok {
+		if _, err := fmt.Fprintf(c.f, "%s %s\n", key, sum); err != nil {
+			return err
+		}
+		c.sums[key] = sum
+		return nil
+	}
+	if recorded != sum {
+		checksumMismatch.WithLabelValues(kind, op).Inc()
+		log.Printf("ALERT: checksum mismatch on %s of %s: recorded %s, got %s", op, key, recorded, sum)
+		return NewError(ErrChecksumMismatch, fmt.Errorf("%s: recorded %s, got %s", key, recorded, sum))
+	}
+	return nil
+}
+
+// hashGoMod returns the go.sum hash of a go.mod file.
+func hashGoMod(data []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// hashZip returns the go.sum hash of a module zip file,
+// like dirhash.HashZip.
+func hashZip(ra io.ReaderAt, size int64) (string, error) {
+	z, err := zip.NewReader(ra, size)
+	if err != nil {
+		return "", err
+	}
+	var files []string
+	zfiles := make(map[string]*zip.File)
+	for _, file := range z.File {
+		files = append(files, file.Name)
+		zfiles[file.Name] = file
+	}
+	return dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+		f := zfiles[name]
+		if f == nil {
+			return nil, fmt.Errorf("file %q not found in zip", name)
+		}
+		return f.Open()
+	})
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func TestChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-checksums-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := module.Version{Path: "example.com/m", Version: "v1.0.0"}
+	var zip, movedZip bytes.Buffer
+	if err := modzip.Create(&zip, m, []modzip.File{memZipFile{"m.go", "package m\n"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := modzip.Create(&movedZip, m, []modzip.File{memZipFile{"m.go", "package m // moved tag\n"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(zip.Bytes())
+	}))
+	defer upstream.Close()
+
+	sums := filepath.Join(dir, "checksums.sum")
+	c, err := OpenChecksums(sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(nil)
+	srv.Checksums = c
+	cache := filepath.Join(dir, "cache")
+	rt := NewRouter(srv, &RouterOptions{Proxy: upstream.URL, DownloadRoot: cache})
+	get := func() int {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/m/@v/v1.0.0.zip", nil))
+		return rec.Code
+	}
+
+	// The first fetch records the hash, which the cached file matches.
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("first fetch: status %d", code)
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("cached fetch: status %d", code)
+	}
+	c.Close()
+
+	// The hashes survive a restart.
+	c, err = OpenChecksums(sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	srv.Checksums = c
+
+	// A tampered cache file is refused.
+	file := filepath.Join(cache, "example.com/m/@v/v1.0.0.zip")
+	if err := ioutil.WriteFile(file, movedZip.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Second))
+	if code := get(); code != http.StatusBadGateway {
+		t.Errorf("tampered cache file: status %d, want %d", code, http.StatusBadGateway)
+	}
+
+	// So is a moved tag upstream, which is not cached.
+	os.Remove(file)
+	zip = movedZip
+	if code := get(); code != http.StatusBadGateway {
+		t.Errorf("moved upstream tag: status %d, want %d", code, http.StatusBadGateway)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("moved upstream tag was cached")
+	}
+
+	if err := c.VerifyData(m, KindMod, []byte("module example.com/m\n")); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Verify(m, KindMod, MemFile([]byte("module example.com/m\n\nrequire example.com/x v1.0.0\n"), time.Now()))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Verify of a changed go.mod: %v, want a checksum mismatch", err)
+	}
+}
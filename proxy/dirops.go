@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// DirOps is a ServerOps serving the module files stored in a directory
+// in the layout of a GOPROXY file:// tree, like a mirror or a vendored
+// corpus, without running the go command:
+//
+//	example.com/m/@v/list
+//	example.com/m/@v/v1.0.0.info
+//	example.com/m/@v/v1.0.0.mod
+//	example.com/m/@v/v1.0.0.zip
+//	example.com/m/@latest
+//
+// The list and @latest files are synthesized from the version files
+// when missing, as are the .info and .mod files of the versions
+// having a zip file.
+type DirOps struct {
+	root string
+}
+
+// NewDirOps returns a DirOps serving the files under root.
+func NewDirOps(root string) *DirOps {
+	return &DirOps{root: root}
+}
+
+// NewContext returns the request context.
+func (d *DirOps) NewContext(r *http.Request) (context.Context, error) {
+	return r.Context(), nil
+}
+
+// List opens the list file of the module, or lists its tagged versions.
+func (d *DirOps) List(ctx context.Context, mpath string) (File, error) {
+	dir, err := d.moduleDir(mpath)
+	if err != nil {
+		return nil, err
+	}
+	if f, err := os.Open(filepath.Join(dir, "@v", "list")); err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	versions, err := d.versions(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, v := range versions {
+		if !module.IsPseudoVersion(v) {
+			list = append(list, v+"\n")
+		}
+	}
+	return MemFile([]byte(strings.Join(list, "")), modTime(filepath.Join(dir, "@v"))), nil
+}
+
+// Latest opens the @latest file of the module, or the info file of
+// its highest release, pre-release or pseudo-version, in that order
+// of preference.
+func (d *DirOps) Latest(ctx context.Context, mpath string) (File, error) {
+	dir, err := d.moduleDir(mpath)
+	if err != nil {
+		return nil, err
+	}
+	if f, err := os.Open(filepath.Join(dir, "@latest")); err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	versions, err := d.versions(dir)
+	if err != nil {
+		return nil, err
+	}
+	latest := latestVersion(versions)
+	if latest == "" {
+		return nil, NewError(ErrNotFound, fmt.Errorf("%s has no versions", mpath))
+	}
+	return d.Info(ctx, module.Version{Path: mpath, Version: latest})
+}
+
+// latestVersion returns the highest release in versions,
+// or else the highest pre-release, or else the highest pseudo-version.
+func latestVersion(versions []string) string {
+	var latest [3]string
+	for _, v := range versions {
+		i := 0
+		switch {
+		case module.IsPseudoVersion(v):
+			i = 2
+		case semver.Prerelease(v) != "":
+			i = 1
+		}
+		if latest[i] == "" || semver.Compare(v, latest[i]) > 0 {
+			latest[i] = v
+		}
+	}
+	for _, v := range latest {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Info opens the info file of the module version.
+func (d *DirOps) Info(ctx context.Context, m module.Version) (File, error) {
+	base, err := d.base(m)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(base + ".info")
+	if os.IsNotExist(err) {
+		if info, zerr := os.Stat(base + ".zip"); zerr == nil {
+			return NewInfo(m.Version, info.ModTime().UTC()), nil
+		}
+	}
+	return f, err
+}
+
+// GoMod opens the go.mod file of the module version.
+func (d *DirOps) GoMod(ctx context.Context, m module.Version) (File, error) {
+	base, err := d.base(m)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(base + ".mod")
+	if os.IsNotExist(err) {
+		if info, zerr := os.Stat(base + ".zip"); zerr == nil {
+			data, zerr := readZipGoMod(m, base+".zip")
+			if zerr != nil {
+				return nil, zerr
+			}
+			if data == nil {
+				data = []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(m.Path)))
+			}
+			return MemFile(data, info.ModTime()), nil
+		}
+	}
+	return f, err
+}
+
+// Zip opens the zip file of the module version.
+func (d *DirOps) Zip(ctx context.Context, m module.Version) (File, error) {
+	base, err := d.base(m)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(base + ".zip")
+}
+
+// versions returns the canonical versions having a file in the
+// @v directory under dir, in semantic version order.
+func (d *DirOps) versions(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, "@v"))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var versions []string
+	for _, fi := range files {
+		ext := path.Ext(fi.Name())
+		if ext != ".info" && ext != ".mod" && ext != ".zip" {
+			continue
+		}
+		v, err := module.UnescapeVersion(strings.TrimSuffix(fi.Name(), ext))
+		if err != nil || v != module.CanonicalVersion(v) || seen[v] {
+			continue
+		}
+		seen[v] = true
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+	return versions, nil
+}
+
+// moduleDir returns the directory of the module mpath.
+func (d *DirOps) moduleDir(mpath string) (string, error) {
+	esc, err := module.EscapePath(mpath)
+	if err != nil {
+		return "", NewError(ErrNotFound, err)
+	}
+	return filepath.Join(d.root, filepath.FromSlash(esc)), nil
+}
+
+// base returns the path of the files of m, without extension.
+func (d *DirOps) base(m module.Version) (string, error) {
+	dir, err := d.moduleDir(m.Path)
+	if err != nil {
+		return "", err
+	}
+	esc, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return "", NewError(ErrInvalidVersion, err)
+	}
+	return filepath.Join(dir, "@v", esc), nil
+}
+
+// modTime returns the modification time of file, or the zero time.
+func modTime(file string) (t time.Time) {
+	if info, err := os.Stat(file); err == nil {
+		t = info.ModTime()
+	}
+	return t
+}
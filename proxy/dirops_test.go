@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func TestDirOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-dirops-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var zip bytes.Buffer
+	m := module.Version{Path: "example.com/M", Version: "v1.1.0"}
+	if err := modzip.Create(&zip, m, []modzip.File{memZipFile{"go.mod", "module example.com/M\n"}}); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"example.com/!m/@v/v1.0.0.info":                             `{"Version":"v1.0.0","Time":"2020-01-01T00:00:00Z"}`,
+		"example.com/!m/@v/v1.0.0.mod":                              "module example.com/M\n",
+		"example.com/!m/@v/v1.1.0.zip":                              zip.String(),
+		"example.com/!m/@v/v1.2.0-pre.info":                         `{"Version":"v1.2.0-pre"}`,
+		"example.com/!m/@v/v0.0.0-20200101000000-abcdefabcdef.info": `{"Version":"v0.0.0-20200101000000-abcdefabcdef"}`,
+		"example.com/listed/@v/list":                                "v0.1.0\n",
+		"example.com/listed/@latest":                                `{"Version":"v0.2.0"}`,
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := NewServer(NewDirOps(dir))
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/example.com/!m/@v/list", 200, "v1.0.0\nv1.1.0\nv1.2.0-pre\n"},
+		{"/example.com/!m/@latest", 200, `"Version":"v1.1.0"`},
+		{"/example.com/!m/@v/v1.0.0.info", 200, `"Version":"v1.0.0"`},
+		{"/example.com/!m/@v/v1.1.0.info", 200, `"Version":"v1.1.0"`},
+		{"/example.com/!m/@v/v1.1.0.mod", 200, "module example.com/M\n"},
+		{"/example.com/!m/@v/v1.1.0.zip", 200, ""},
+		{"/example.com/!m/@v/v1.0.0.zip", 404, ""},
+		{"/example.com/!m/@v/master.info", 404, ""},
+		{"/example.com/listed/@v/list", 200, "v0.1.0\n"},
+		{"/example.com/listed/@latest", 200, `"Version":"v0.2.0"`},
+		{"/example.com/missing/@v/list", 404, ""},
+		{"/example.com/missing/@latest", 404, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.code {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rec.Code, tt.code)
+			continue
+		}
+		if tt.body != "" && !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("GET %s: body %q, want %q", tt.path, rec.Body.String(), tt.body)
+		}
+	}
+
+	// Without releases, the latest version is the highest pre-release.
+	os.Remove(filepath.Join(dir, "example.com/!m/@v/v1.0.0.info"))
+	os.Remove(filepath.Join(dir, "example.com/!m/@v/v1.0.0.mod"))
+	os.Remove(filepath.Join(dir, "example.com/!m/@v/v1.1.0.zip"))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/!m/@latest", nil))
+	if !strings.Contains(rec.Body.String(), "v1.2.0-pre") {
+		t.Errorf("latest without releases = %q, want v1.2.0-pre", rec.Body.String())
+	}
+}
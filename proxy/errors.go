@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Kinds of errors returned by ServerOps implementations.
+// They are mapped to HTTP status codes by StatusCode.
+var (
+	// ErrNotFound reports that the module or version does not exist.
+	// Errors of this kind also satisfy errors.Is(err, os.ErrNotExist).
+	ErrNotFound = errors.New("not found")
+	// ErrGone reports that the module or version existed
+	// but has been removed and will not come back.
+	ErrGone = errors.New("gone")
+	// ErrForbidden reports that serving the module is disallowed by policy.
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalidVersion reports a malformed or unresolvable version.
+	ErrInvalidVersion = errors.New("invalid version")
+	// ErrUpstreamTimeout reports that the origin (VCS host or upstream proxy)
+	// did not answer in time.
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+	// ErrVCSAuth reports that the origin VCS host refused the credentials
+	// of the proxy.
+	ErrVCSAuth = errors.New("vcs authentication failed")
+	// ErrOverloaded reports that the request was turned away
+	// because too many are already in progress.
+	ErrOverloaded = errors.New("overloaded")
+	// ErrConflict reports an attempt to change a published,
+	// and therefore immutable, module version.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidArtifact reports a malformed uploaded file.
+	ErrInvalidArtifact = errors.New("invalid artifact")
+	// ErrChecksumMismatch reports a module file whose contents differ
+	// from the ones served before; such files are never served.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// An Error is an error of a particular kind, like ErrNotFound,
+// wrapping the underlying failure.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// NewError returns an Error of the given kind wrapping err.
+func NewError(kind, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of kind target.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind || (e.Kind == ErrNotFound && target == os.ErrNotExist)
+}
+
+// StatusCode returns the HTTP status code a Server responds with for err.
+// Errors that are not of a known kind result in a 500 error.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, os.ErrNotExist), errors.Is(err, ErrInvalidVersion):
+		return http.StatusNotFound
+	case errors.Is(err, ErrGone):
+		return http.StatusGone
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUpstreamTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrVCSAuth), errors.Is(err, ErrChecksumMismatch):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrOverloaded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidArtifact):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// A retryAfterError is an error suggesting a delay before retrying.
+type retryAfterError struct {
+	error
+	after time.Duration
+}
+
+// Unwrap returns the underlying error.
+func (e *retryAfterError) Unwrap() error {
+	return e.error
+}
+
+// RetryAfter returns the delay suggested by err before retrying, if any.
+func RetryAfter(err error) (time.Duration, bool) {
+	var re *retryAfterError
+	if errors.As(err, &re) {
+		return re.after, true
+	}
+	return 0, false
+}
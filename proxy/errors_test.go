@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{NewError(ErrNotFound, errors.New("x")), http.StatusNotFound},
+		{fmt.Errorf("open: %w", os.ErrNotExist), http.StatusNotFound},
+		{NewError(ErrInvalidVersion, errors.New("x")), http.StatusNotFound},
+		{NewError(ErrGone, errors.New("x")), http.StatusGone},
+		{NewError(ErrForbidden, errors.New("x")), http.StatusForbidden},
+		{NewError(ErrUpstreamTimeout, errors.New("x")), http.StatusGatewayTimeout},
+		{NewError(ErrVCSAuth, errors.New("x")), http.StatusBadGateway},
+		{NewError(ErrChecksumMismatch, errors.New("x")), http.StatusBadGateway},
+		{NewError(ErrOverloaded, errors.New("x")), http.StatusServiceUnavailable},
+		{NewError(ErrConflict, errors.New("x")), http.StatusConflict},
+		{NewError(ErrInvalidArtifact, errors.New("x")), http.StatusBadRequest},
+		{fmt.Errorf("wrapped: %w", NewError(ErrGone, errors.New("x"))), http.StatusGone},
+		{errors.New("x"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if code := StatusCode(tt.err); code != tt.code {
+			t.Errorf("StatusCode(%v) = %d, want %d", tt.err, code, tt.code)
+		}
+	}
+	if !errors.Is(NewError(ErrNotFound, errors.New("x")), os.ErrNotExist) {
+		t.Errorf("ErrNotFound error does not satisfy errors.Is(err, os.ErrNotExist)")
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Limits of the number of entries returned by an Index query.
+const (
+	DefaultIndexLimit = 2000
+	MaxIndexLimit     = 2000
+)
+
+// An IndexEntry records the first time a module version was served,
+// in the format of index.golang.org.
+type IndexEntry struct {
+	Path      string
+	Version   string
+	Timestamp time.Time
+}
+
+// An Index is a feed of the module versions served by the proxy,
+// persisted as JSON lines in a file.
+//
+// Index.Handler records the versions of the successful .mod and .zip
+// responses, and Index.ServeHTTP serves the feed like index.golang.org:
+//
+//	GET /index?since=2019-04-10T19:08:52.997264Z&limit=10
+type Index struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries []IndexEntry // in Timestamp order
+	seen    map[module.Version]time.Time
+}
+
+// OpenIndex opens the index stored in file, creating it if needed.
+func OpenIndex(file string) (*Index, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	x := &Index{f: f, seen: make(map[module.Version]time.Time)}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e IndexEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// Skip a line truncated by a crash.
+			continue
+		}
+		x.entries = append(x.entries, e)
+		x.seen[module.Version{Path: e.Path, Version: e.Version}] = e.Timestamp
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading index %s: %v", file, err)
+	}
+	return x, nil
+}
+
+// Add records m if it has not been recorded yet.
+func (x *Index) Add(m module.Version) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.seen[m]; ok {
+		return nil
+	}
+	e := IndexEntry{Path: m.Path, Version: m.Version, Timestamp: time.Now().UTC()}
+	if n := len(x.entries); n > 0 && e.Timestamp.Before(x.entries[n-1].Timestamp) {
+		// Keep the feed ordered despite clock adjustments.
+		e.Timestamp = x.entries[n-1].Timestamp
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := x.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	x.entries = append(x.entries, e)
+	x.seen[m] = e.Timestamp
+	return nil
+}
+
+// First reports when m was first recorded.
+func (x *Index) First(m module.Version) (time.Time, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	t, ok := x.seen[m]
+	return t, ok
+}
+
+// Since returns at most limit entries recorded at or after since.
+func (x *Index) Since(since time.Time, limit int) []IndexEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	i := sort.Search(len(x.entries), func(i int) bool {
+		return !x.entries[i].Timestamp.Before(since)
+	})
+	j := len(x.entries)
+	if j-i > limit {
+		j = i + limit
+	}
+	return append([]IndexEntry(nil), x.entries[i:j]...)
+}
+
+// Close closes the index file.
+func (x *Index) Close() error {
+	return x.f.Close()
+}
+
+// ServeHTTP serves the entries selected by the since and limit
+// query parameters as JSON lines.
+func (x *Index) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	limit := DefaultIndexLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > MaxIndexLimit {
+		limit = MaxIndexLimit
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	for _, e := range x.Since(since, limit) {
+		enc.Encode(e)
+	}
+}
+
+// Handler returns h wrapped so that the module versions
+// of its successful .mod and .zip responses are recorded.
+func (x *Index) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := NewMetricsResponseWriter(w)
+		h.ServeHTTP(mw, r)
+		if r.Method != http.MethodGet || (mw.statusCode != 0 && mw.statusCode != http.StatusOK) {
+			return
+		}
+		mod, vers, kind := parseRequestPath(r.URL.Path)
+		if (kind != KindMod && kind != KindZip) || vers == "" || vers != module.CanonicalVersion(vers) {
+			return
+		}
+		if err := x.Add(module.Version{Path: mod, Version: vers}); err != nil {
+			log.Printf("index: recording %s@%s: %v", mod, vers, err)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index.jsonl")
+
+	x, err := OpenIndex(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	h := x.Handler(ok)
+	for _, p := range []string{
+		"/example.com/a/@v/v1.0.0.mod",
+		"/example.com/a/@v/v1.0.0.zip",
+		"/example.com/a/@v/master.info",
+		"/example.com/a/@v/list",
+		"/example.com/!b/@v/v0.1.0.zip",
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+	x.Close()
+
+	// Entries survive a restart.
+	x, err = OpenIndex(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	x.Add(module.Version{Path: "example.com/a", Version: "v1.0.0"})
+
+	rec := httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/index", nil))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	var got []string
+	var last time.Time
+	for _, line := range lines {
+		var e IndexEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad index line %q: %v", line, err)
+		}
+		got = append(got, e.Path+"@"+e.Version)
+		last = e.Timestamp
+	}
+	if want := "example.com/a@v1.0.0 example.com/B@v0.1.0"; strings.Join(got, " ") != want {
+		t.Errorf("index = %v, want %v", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/index?limit=1&since="+last.Format(time.RFC3339Nano), nil))
+	if !strings.Contains(rec.Body.String(), "example.com/B") || strings.Count(rec.Body.String(), "\n") != 1 {
+		t.Errorf("index since %v = %q, want the last entry only", last, rec.Body.String())
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultRetryAfter is the delay suggested to clients
+// turned away by a full Limiter.
+const DefaultRetryAfter = 10 * time.Second
+
+// A Limiter is a weighted semaphore bounding the concurrent
+// executions of some expensive operation, such as running the go command.
+// Callers that cannot acquire the semaphore immediately wait in a
+// first-in first-out queue; once the queue is full, Acquire fails
+// with an ErrOverloaded error.
+type Limiter struct {
+	name     string
+	size     int64
+	maxQueue int
+
+	// RetryAfter is the delay suggested to rejected callers.
+	RetryAfter time.Duration
+
+	mu      sync.Mutex
+	cur     int64
+	waiters list.List
+}
+
+type waiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// NewLimiter returns a Limiter named name (as reported in metrics)
+// allowing executions of a total weight of size at a time,
+// with at most maxQueue waiting callers.
+func NewLimiter(name string, size int64, maxQueue int) *Limiter {
+	return &Limiter{name: name, size: size, maxQueue: maxQueue, RetryAfter: DefaultRetryAfter}
+}
+
+// Acquire acquires the semaphore with a weight of n, blocking until
+// resources are available or ctx is done. On success, the returned
+// function must be called to release the semaphore.
+func (l *Limiter) Acquire(ctx context.Context, n int64) (release func(), err error) {
+	if n > l.size {
+		n = l.size
+	}
+	l.mu.Lock()
+	if l.size-l.cur >= n && l.waiters.Len() == 0 {
+		l.cur += n
+		l.mu.Unlock()
+		execActive.WithLabelValues(l.name).Add(float64(n))
+		return func() { l.release(n) }, nil
+	}
+	if l.waiters.Len() >= l.maxQueue {
+		l.mu.Unlock()
+		execRejected.WithLabelValues(l.name).Inc()
+		return nil, &retryAfterError{
+			error: NewError(ErrOverloaded, fmt.Errorf("%s queue is full", l.name)),
+			after: l.RetryAfter,
+		}
+	}
+	w := waiter{n: n, ready: make(chan struct{})}
+	el := l.waiters.PushBack(w)
+	l.mu.Unlock()
+	execQueued.WithLabelValues(l.name).Inc()
+	defer execQueued.WithLabelValues(l.name).Dec()
+
+	select {
+	case <-w.ready:
+		execActive.WithLabelValues(l.name).Add(float64(n))
+		return func() { l.release(n) }, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		select {
+		case <-w.ready:
+			// Acquired after being cancelled; give it back.
+			l.cur -= n
+			l.notifyWaiters()
+		default:
+			isFront := l.waiters.Front() == el
+			l.waiters.Remove(el)
+			if isFront && l.size > l.cur {
+				l.notifyWaiters()
+			}
+		}
+		l.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Limiter) release(n int64) {
+	execActive.WithLabelValues(l.name).Sub(float64(n))
+	l.mu.Lock()
+	l.cur -= n
+	l.notifyWaiters()
+	l.mu.Unlock()
+}
+
+// notifyWaiters wakes up the waiters at the front of the queue
+// that fit in the available weight. l.mu must be held.
+func (l *Limiter) notifyWaiters() {
+	for {
+		next := l.waiters.Front()
+		if next == nil {
+			return
+		}
+		w := next.Value.(waiter)
+		if l.size-l.cur < w.n {
+			return
+		}
+		l.cur += w.n
+		l.waiters.Remove(next)
+		close(w.ready)
+	}
+}
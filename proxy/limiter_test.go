@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter("test", 2, 1)
+	ctx := context.Background()
+
+	r1, err := l.Acquire(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := l.Acquire(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		r, err := l.Acquire(ctx, 1)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- r
+	}()
+	// Wait for the goroutine to be queued.
+	for {
+		l.mu.Lock()
+		n := l.waiters.Len()
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = l.Acquire(ctx, 1)
+	if !errors.Is(err, ErrOverloaded) || StatusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("Acquire with full queue: got %v, want ErrOverloaded", err)
+	}
+	if after, ok := RetryAfter(err); !ok || after != DefaultRetryAfter {
+		t.Errorf("RetryAfter = %v, %v, want %v, true", after, ok, DefaultRetryAfter)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	r1()
+	r3 := <-acquired
+	if _, err := l.Acquire(cctx, 1); err != context.Canceled {
+		t.Errorf("Acquire with cancelled context: got %v, want %v", err, context.Canceled)
+	}
+	r2()
+	r3()
+	if l.cur != 0 {
+		t.Errorf("weight in use after release: %d", l.cur)
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/mod/module"
+)
+
+// Merge decides whether the versions of a module path are merged
+// from the upstream proxy and the direct source.
+func (rt *Router) Merge(path string) bool {
+	if rt.opts == nil || rt.opts.Merge == "" {
+		return false
+	}
+	return GlobsMatchPath(rt.opts.Merge, path)
+}
+
+// upstreamOps is a ServerOps fetching the files from the upstream
+// proxy of a Router, caching the .info, .mod and .zip files.
+type upstreamOps struct {
+	rt *Router
+}
+
+func (o upstreamOps) NewContext(r *http.Request) (context.Context, error) {
+	return r.Context(), nil
+}
+
+// fetch returns the upstream file at the escaped path p,
+// from the cache if cache is set.
+func (o upstreamOps) fetch(ctx context.Context, p string, cache bool) (File, error) {
+	file := o.rt.downloadRoot + p
+	if cache {
+		if f, err := os.Open(file); err == nil {
+			return f, nil
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(o.rt.opts.Proxy, "/")+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, span := startSpan(req, "upstream", attribute.String("http.path", p))
+	injectTrace(req)
+	resp, err := o.rt.client.Do(req)
+	if err != nil {
+		upstreamErrors.WithLabelValues("transport").Inc()
+		endSpan(span, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		endSpan(span, nil)
+		return nil, NewError(ErrNotFound, fmt.Errorf("upstream: %s: %s", p, resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		upstreamErrors.WithLabelValues("status").Inc()
+		err = fmt.Errorf("upstream: %s: %s", p, resp.Status)
+		endSpan(span, err)
+		return nil, err
+	}
+	buf, err := readBody(resp)
+	if err == nil {
+		if err = validateArtifact(p, buf); err != nil {
+			upstreamErrors.WithLabelValues("invalid").Inc()
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if cache {
+		if err := o.rt.cacheFile(p, buf); err != nil {
+			return nil, err
+		}
+	}
+	return MemFile(buf, time.Now()), nil
+}
+
+func (o upstreamOps) List(ctx context.Context, path string) (File, error) {
+	esc, err := module.EscapePath(path)
+	if err != nil {
+		return nil, NewError(ErrNotFound, err)
+	}
+	return o.fetch(ctx, "/"+esc+"/@v/list", false)
+}
+
+func (o upstreamOps) Latest(ctx context.Context, path string) (File, error) {
+	esc, err := module.EscapePath(path)
+	if err != nil {
+		return nil, NewError(ErrNotFound, err)
+	}
+	return o.fetch(ctx, "/"+esc+"/@latest", false)
+}
+
+func (o upstreamOps) file(ctx context.Context, m module.Version, ext string) (File, error) {
+	esc, err := module.EscapePath(m.Path)
+	if err != nil {
+		return nil, NewError(ErrNotFound, err)
+	}
+	escVers, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return nil, NewError(ErrInvalidVersion, err)
+	}
+	// Only files of canonical versions are immutable.
+	return o.fetch(ctx, "/"+esc+"/@v/"+escVers+ext, m.Version == module.CanonicalVersion(m.Version))
+}
+
+func (o upstreamOps) Info(ctx context.Context, m module.Version) (File, error) {
+	return o.file(ctx, m, ".info")
+}
+
+func (o upstreamOps) GoMod(ctx context.Context, m module.Version) (File, error) {
+	return o.file(ctx, m, ".mod")
+}
+
+func (o upstreamOps) Zip(ctx context.Context, m module.Version) (File, error) {
+	return o.file(ctx, m, ".zip")
+}
+
+// mergedOps is a ServerOps computing the latest version
+// over the merged list of the versions of its backends.
+type mergedOps struct {
+	ServerOps
+}
+
+// Latest returns the info file of the latest listed version,
+// or else the latest version known to the first backend having the module.
+func (o mergedOps) Latest(ctx context.Context, path string) (File, error) {
+	f, err := o.List(ctx, path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if v := latestVersion(strings.Fields(string(data))); v != "" {
+			return o.Info(ctx, module.Version{Path: path, Version: v})
+		}
+	}
+	return o.ServerOps.Latest(ctx, path)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRouterMerge(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/m/@v/list", "/example.com/other/@v/list":
+			w.Write([]byte("v1.0.0\nv1.1.0\n"))
+		case "/example.com/m/@latest", "/example.com/m/@v/v1.1.0.info":
+			w.Write([]byte(`{"Version":"v1.1.0","Time":"2020-01-01T00:00:00Z"}`))
+		case "/example.com/m/@v/v1.0.0.mod":
+			w.Write([]byte("module example.com/m\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "goproxy-merge-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	direct := &fakeOps{name: "direct", versions: []string{"v1.0.0", "v1.2.0"}}
+	rt := NewRouter(NewServer(direct), &RouterOptions{
+		Proxy:        upstream.URL,
+		DownloadRoot: dir,
+		Merge:        "example.com/m",
+	})
+	tests := []struct {
+		path string
+		code int
+		body string
+		mode string
+	}{
+		{"/example.com/m/@v/list", 200, "v1.0.0\nv1.1.0\nv1.2.0\n", ModeMerged},
+		{"/example.com/m/@latest", 200, "// direct\n", ModeMerged},
+		{"/example.com/m/@v/v1.0.0.mod", 200, "module example.com/m\n", ModeMerged},
+		{"/example.com/m/@v/v1.2.0.mod", 200, "// direct\n", ModeMerged},
+		{"/example.com/m/@v/v1.3.0.mod", 404, "", ModeMerged},
+		// Other modules are served from the upstream only.
+		{"/example.com/other/@v/list", 200, "v1.0.0\nv1.1.0\n", ModeProxy},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r, info := WithRequestInfo(httptest.NewRequest(http.MethodGet, tt.path, nil))
+		rt.ServeHTTP(rec, r)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("GET %s: %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.code, tt.body)
+		}
+		if info.Mode != tt.mode {
+			t.Errorf("GET %s: mode %q, want %q", tt.path, info.Mode, tt.mode)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package proxy
 import (
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -14,15 +17,164 @@ var (
 		Name:      "request_total",
 		Help:      "total request in HTTP",
 	}, []string{"mode", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "goproxy",
+		Subsystem: "router",
+		Name:      "request_duration_seconds",
+		Help:      "time spent answering HTTP requests",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"mode", "kind"})
+	responseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "router",
+		Name:      "response_bytes_total",
+		Help:      "bytes served in HTTP response bodies",
+	}, []string{"mode", "kind"})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "upstream",
+		Name:      "errors_total",
+		Help:      "failed requests to the upstream proxy",
+	}, []string{"reason"})
+	cacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goproxy",
+		Subsystem: "cache",
+		Name:      "bytes",
+		Help:      "size of the cached files",
+	}, []string{"kind"})
+	cacheFiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goproxy",
+		Subsystem: "cache",
+		Name:      "files",
+		Help:      "number of the cached files",
+	}, []string{"kind"})
+	execActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goproxy",
+		Subsystem: "exec",
+		Name:      "active",
+		Help:      "weight of the executions holding a limiter",
+	}, []string{"pool"})
+	execQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goproxy",
+		Subsystem: "exec",
+		Name:      "queued",
+		Help:      "executions waiting for a limiter",
+	}, []string{"pool"})
+	execRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "exec",
+		Name:      "rejected_total",
+		Help:      "executions rejected because the limiter queue was full",
+	}, []string{"pool"})
+	throttledRequest = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "ratelimit",
+		Name:      "throttled_total",
+		Help:      "requests rejected by the per-client rate limit",
+	}, []string{"budget"})
+	checksumMismatch = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "checksum",
+		Name:      "mismatch_total",
+		Help:      "module files refused because their hash differs from the recorded one",
+	}, []string{"kind", "op"})
+	toolchainRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "toolchain",
+		Name:      "requests_total",
+		Help:      "requests for the files of the Go toolchain module",
+	}, []string{"version", "platform", "kind", "status"})
+	toolchainCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goproxy",
+		Subsystem: "toolchain",
+		Name:      "cache_bytes",
+		Help:      "size of the cached files of the Go toolchain module",
+	})
+	toolchainEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goproxy",
+		Subsystem: "toolchain",
+		Name:      "evicted_total",
+		Help:      "toolchain versions removed from the cache after their retention",
+	})
 )
 
 func init() {
-	prometheus.MustRegister(totalRequest)
+	prometheus.MustRegister(totalRequest, requestDuration, responseBytes, upstreamErrors,
+		cacheBytes, cacheFiles, execActive, execQueued, execRejected, throttledRequest, checksumMismatch,
+		toolchainRequests, toolchainCacheBytes, toolchainEvicted)
+}
+
+// MetricsHandler returns h wrapped so that its requests are counted
+// and timed by mode and artifact kind.
+func MetricsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := GetRequestInfo(r)
+		if info == nil {
+			r, info = WithRequestInfo(r)
+		}
+		start := time.Now()
+		mw := NewMetricsResponseWriter(w)
+		h.ServeHTTP(mw, r)
+		mode := info.Mode
+		if mode == "" {
+			mode = "none"
+		}
+		totalRequest.With(prometheus.Labels{"mode": mode, "status": mw.status()}).Inc()
+		requestDuration.With(prometheus.Labels{"mode": mode, "kind": info.Kind}).Observe(time.Since(start).Seconds())
+		responseBytes.With(prometheus.Labels{"mode": mode, "kind": info.Kind}).Add(float64(mw.bytes))
+	})
+}
+
+// WatchCacheSize updates the cache size metrics of the files
+// under root every interval, until stop is closed.
+func WatchCacheSize(root string, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		updateCacheSize(root)
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func updateCacheSize(root string) {
+	size := make(map[string]int64)
+	files := make(map[string]int64)
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		var kind string
+		switch filepath.Ext(p) {
+		case ".info":
+			kind = KindInfo
+		case ".mod":
+			kind = KindMod
+		case ".zip":
+			kind = KindZip
+		default:
+			if filepath.Base(p) != "list" {
+				return nil
+			}
+			kind = KindList
+		}
+		size[kind] += info.Size()
+		files[kind]++
+		return nil
+	})
+	for _, kind := range []string{KindList, KindInfo, KindMod, KindZip} {
+		cacheBytes.WithLabelValues(kind).Set(float64(size[kind]))
+		cacheFiles.WithLabelValues(kind).Set(float64(files[kind]))
+	}
 }
 
 type metricsResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (mw metricsResponseWriter) status() string {
@@ -33,7 +185,7 @@ func (mw metricsResponseWriter) status() string {
 func NewMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
 	// WriteHeader(int) is not called if our response implicitly returns 0, so
 	// we default to that status code.
-	return &metricsResponseWriter{w, 0}
+	return &metricsResponseWriter{w, 0, 0}
 }
 
 // WriteHeader implements http.ResponseWriter.
@@ -41,3 +193,13 @@ func (mw *metricsResponseWriter) WriteHeader(code int) {
 	mw.statusCode = code
 	mw.ResponseWriter.WriteHeader(code)
 }
+
+// Write implements http.ResponseWriter.
+func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
+	if mw.statusCode == 0 {
+		mw.statusCode = http.StatusOK
+	}
+	n, err := mw.ResponseWriter.Write(b)
+	mw.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	h := MetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setMode(r, ModeCached)
+		if strings.HasSuffix(r.URL.Path, ".zip") {
+			time.Sleep(20 * time.Millisecond)
+			w.Write(make([]byte, 1000))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	// histogram returns the observations of the request durations.
+	histogram := func(kind string) *dto.Histogram {
+		var m dto.Metric
+		if err := requestDuration.With(prometheus.Labels{"mode": ModeCached, "kind": kind}).(prometheus.Metric).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram()
+	}
+	bytesServed := responseBytes.With(prometheus.Labels{"mode": ModeCached, "kind": "zip"})
+	ok := totalRequest.With(prometheus.Labels{"mode": ModeCached, "status": "200"})
+	notFound := totalRequest.With(prometheus.Labels{"mode": ModeCached, "status": "404"})
+
+	zipCount, zipSum := histogram("zip").GetSampleCount(), histogram("zip").GetSampleSum()
+	infoCount := histogram("info").GetSampleCount()
+	bytesBefore, okBefore, notFoundBefore := testutil.ToFloat64(bytesServed), testutil.ToFloat64(ok), testutil.ToFloat64(notFound)
+	for _, p := range []string{"/example.com/m/@v/v1.0.0.zip", "/example.com/m/@v/v1.0.0.zip", "/example.com/m/@v/v1.0.0.info"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+
+	zip := histogram("zip")
+	if n := zip.GetSampleCount() - zipCount; n != 2 {
+		t.Errorf("got %d zip durations observed, want 2", n)
+	}
+	if d := zip.GetSampleSum() - zipSum; d < 0.04 {
+		t.Errorf("got %.3fs of zip durations, want at least 0.040s", d)
+	}
+	for _, b := range zip.GetBucket() {
+		// Both requests took at least 20ms.
+		if b.GetUpperBound() < 0.02 && b.GetCumulativeCount() > zipCount {
+			t.Errorf("bucket le=%g has %d zip durations, want at most %d", b.GetUpperBound(), b.GetCumulativeCount(), zipCount)
+		}
+	}
+	if n := histogram("info").GetSampleCount() - infoCount; n != 1 {
+		t.Errorf("got %d info durations observed, want 1", n)
+	}
+	if n := testutil.ToFloat64(bytesServed) - bytesBefore; n != 2000 {
+		t.Errorf("got %v zip bytes counted, want 2000", n)
+	}
+	if n := testutil.ToFloat64(ok) - okBefore; n != 2 {
+		t.Errorf("got %v requests counted with status 200, want 2", n)
+	}
+	if n := testutil.ToFloat64(notFound) - notFoundBefore; n != 1 {
+		t.Errorf("got %v requests counted with status 404, want 1", n)
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// Artifact kinds of module proxy requests, as used by the NegativeCache
+// TTL table.
+const (
+	KindList   = "list"
+	KindLatest = "latest"
+	KindInfo   = "info"
+	KindMod    = "mod"
+	KindZip    = "zip"
+)
+
+// maxNegativeBody bounds the size of error text remembered per entry.
+const maxNegativeBody = 4 << 10
+
+// ArtifactKind returns the artifact kind requested by the module proxy
+// URL path p, or "" if p is not a module proxy request.
+func ArtifactKind(p string) string {
+	i := strings.Index(p, "/@")
+	if i < 0 {
+		return ""
+	}
+	what := p[i+len("/@"):]
+	switch what {
+	case "latest":
+		return KindLatest
+	case "v/list":
+		return KindList
+	}
+	if !strings.HasPrefix(what, "v/") {
+		return ""
+	}
+	switch path.Ext(what) {
+	case ".info":
+		return KindInfo
+	case ".mod":
+		return KindMod
+	case ".zip":
+		return KindZip
+	}
+	return ""
+}
+
+// A NegativeCache is an http.Handler middleware remembering
+// 404 Not Found and 410 Gone responses for module proxy requests,
+// so that repeated requests for missing modules are answered
+// without running the go command or asking the upstream proxy again.
+//
+// The cache holds a bounded number of entries, evicting the least recently
+// used ones first. Entries expire after the TTL configured for their
+// artifact kind; kinds without a TTL are never cached.
+type NegativeCache struct {
+	size int
+	ttl  map[string]time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type negativeEntry struct {
+	key     string
+	code    int
+	text    []byte
+	expires time.Time
+}
+
+// NewNegativeCache returns a NegativeCache holding at most size entries,
+// using the given TTL per artifact kind (KindList, KindLatest and so on).
+func NewNegativeCache(size int, ttl map[string]time.Duration) *NegativeCache {
+	return &NegativeCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Handler returns h wrapped so that its 404 and 410 responses are cached.
+func (c *NegativeCache) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ttl := c.ttl[ArtifactKind(r.URL.Path)]
+		if c.size <= 0 || ttl <= 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if e, ok := c.get(r.URL.Path); ok {
+			setMode(r, ModeNegative)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(e.code)
+			w.Write(e.text)
+			return
+		}
+		nw := &negativeResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(nw, r)
+		if nw.code == http.StatusNotFound || nw.code == http.StatusGone {
+			c.add(r.URL.Path, nw.code, nw.text.Bytes(), ttl)
+		}
+	})
+}
+
+func (c *NegativeCache) get(key string) (negativeEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return negativeEntry{}, false
+	}
+	e := el.Value.(*negativeEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return negativeEntry{}, false
+	}
+	c.lru.MoveToFront(el)
+	return *e, true
+}
+
+func (c *NegativeCache) add(key string, code int, text []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &negativeEntry{key: key, code: code, text: text, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*negativeEntry).key)
+	}
+}
+
+// Invalidate removes the cached entries of the module modPath,
+// or all entries if modPath is empty, and reports how many were removed.
+func (c *NegativeCache) Invalidate(modPath string) (int, error) {
+	escMod, err := module.EscapePath(modPath)
+	if modPath != "" && err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := "/" + escMod + "/@"
+	n := 0
+	for key, el := range c.entries {
+		if modPath == "" || strings.HasPrefix(key, prefix) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// A negativeResponseWriter records the status code
+// and the error text of a response.
+type negativeResponseWriter struct {
+	http.ResponseWriter
+	code int
+	text bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *negativeResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.
+func (w *negativeResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if (w.code == http.StatusNotFound || w.code == http.StatusGone) && w.text.Len() < maxNegativeBody {
+		n := len(b)
+		if rest := maxNegativeBody - w.text.Len(); n > rest {
+			n = rest
+		}
+		w.text.Write(b[:n])
+	}
+	return w.ResponseWriter.Write(b)
+}
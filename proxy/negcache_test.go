@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	calls := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "not found: "+r.URL.Path, http.StatusNotFound)
+	})
+	c := NewNegativeCache(2, map[string]time.Duration{KindInfo: time.Hour})
+	nh := c.Handler(h)
+
+	get := func(p string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		nh.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := get("/example.com/m/@v/v1.0.0.info")
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotFound)
+		}
+		if want := "not found: /example.com/m/@v/v1.0.0.info\n"; rec.Body.String() != want {
+			t.Fatalf("got body %q, want %q", rec.Body.String(), want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+
+	// Kinds without a TTL are not cached.
+	get("/example.com/m/@v/list")
+	get("/example.com/m/@v/list")
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+
+	// The oldest entry is evicted once the cache is full.
+	get("/example.com/a/@v/v1.0.0.info")
+	get("/example.com/b/@v/v1.0.0.info")
+	get("/example.com/m/@v/v1.0.0.info")
+	if calls != 6 {
+		t.Errorf("handler called %d times, want 6", calls)
+	}
+
+	if n, err := c.Invalidate("example.com/m"); err != nil || n != 1 {
+		t.Errorf("Invalidate = %d, %v, want 1, nil", n, err)
+	}
+	get("/example.com/m/@v/v1.0.0.info")
+	if calls != 7 {
+		t.Errorf("handler called %d times, want 7", calls)
+	}
+}
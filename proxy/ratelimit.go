@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Budgets of the RateLimiter.
+const (
+	// BudgetMeta covers the cheap requests: list, latest, info, mod and sumdb.
+	BudgetMeta = "meta"
+	// BudgetZip covers the zip requests.
+	BudgetZip = "zip"
+)
+
+// RateLimitOptions configures a RateLimiter.
+type RateLimitOptions struct {
+	// Key selects how clients are identified:
+	// "ip" (the default) uses the remote address,
+	// "user" the identity returned by Identify,
+	// and "header:Name" the value of the Name request header.
+	// Requests without a verified identity or header
+	// fall back to the remote address.
+	Key string
+	// Identify, if not nil, returns the verified identity of the client
+	// sending r, and false if r is not authenticated.
+	Identify func(r *http.Request) (string, bool)
+	// MetaRate is the number of metadata requests per second
+	// allowed for each client, and MetaBurst the bucket size.
+	// A zero MetaRate disables the limit.
+	MetaRate  float64
+	MetaBurst int
+	// ZipRate and ZipBurst are the same for zip requests.
+	ZipRate  float64
+	ZipBurst int
+}
+
+// A RateLimiter is an http.Handler middleware limiting the rate of
+// requests of each client with token buckets, answering
+// 429 Too Many Requests when a client exceeds its budget.
+type RateLimiter struct {
+	opts RateLimitOptions
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter using the given options.
+func NewRateLimiter(opts *RateLimitOptions) *RateLimiter {
+	return &RateLimiter{
+		opts:      *opts,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Handler returns h wrapped so that clients exceeding their budget
+// are turned away.
+func (l *RateLimiter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget, rate, burst := BudgetMeta, l.opts.MetaRate, l.opts.MetaBurst
+		if ArtifactKind(r.URL.Path) == KindZip {
+			budget, rate, burst = BudgetZip, l.opts.ZipRate, l.opts.ZipBurst
+		}
+		if rate <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if wait := l.take(budget+" "+l.client(r), rate, burst); wait > 0 {
+			setMode(r, ModeThrottled)
+			throttledRequest.WithLabelValues(budget).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// client returns the identity of the client sending r.
+func (l *RateLimiter) client(r *http.Request) string {
+	switch {
+	case l.opts.Key == "user":
+		if l.opts.Identify != nil {
+			if id, ok := l.opts.Identify(r); ok {
+				return "user:" + id
+			}
+		}
+	case strings.HasPrefix(l.opts.Key, "header:"):
+		if v := r.Header.Get(strings.TrimPrefix(l.opts.Key, "header:")); v != "" {
+			return "header:" + v
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// take takes a token from the bucket key, refilled at rate tokens
+// per second up to burst, and returns zero on success or
+// the time until a token is available.
+func (l *RateLimiter) take(key string, rate float64, burst int) time.Duration {
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// sweep drops the buckets of clients idle for long enough
+// to have their bucket refilled. l.mu must be held.
+func (l *RateLimiter) sweep(now time.Time) {
+	const every = time.Minute
+	if now.Sub(l.lastSweep) < every {
+		return
+	}
+	l.lastSweep = now
+	idle := every
+	for _, r := range []struct {
+		rate  float64
+		burst int
+	}{{l.opts.MetaRate, l.opts.MetaBurst}, {l.opts.ZipRate, l.opts.ZipBurst}} {
+		if r.rate > 0 {
+			if d := time.Duration(float64(r.burst) / r.rate * float64(time.Second)); d > idle {
+				idle = d
+			}
+		}
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(&RateLimitOptions{MetaRate: 1, MetaBurst: 2})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(p string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, p, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := get("/example.com/m/@v/list"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+	rec := get("/example.com/m/@v/list")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want %q", got, "1")
+	}
+
+	// Zip requests have their own budget, unlimited here.
+	if rec := get("/example.com/m/@v/v1.0.0.zip"); rec.Code != http.StatusOK {
+		t.Errorf("zip: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// The bucket refills at the rate.
+	l.mu.Lock()
+	l.buckets[BudgetMeta+" ip:192.0.2.1"].last = time.Now().Add(-1500 * time.Millisecond)
+	l.mu.Unlock()
+	if rec := get("/example.com/m/@v/list"); rec.Code != http.StatusOK {
+		t.Fatalf("after refill: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := get("/example.com/m/@v/list"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("after refill: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimiterClient(t *testing.T) {
+	u := NewUploads("", []string{"secret"})
+	id, _ := u.Identity(&http.Request{Header: http.Header{"Authorization": {"Bearer secret"}}})
+	for _, tt := range []struct {
+		key    string
+		header http.Header
+		user   string
+		pass   string
+		want   string
+	}{
+		{key: "ip", want: "ip:192.0.2.1"},
+		{key: "ip", header: http.Header{"X-Ci-Job": {"42"}}, want: "ip:192.0.2.1"},
+		{key: "header:X-CI-Job", header: http.Header{"X-Ci-Job": {"42"}}, want: "header:42"},
+		{key: "header:X-CI-Job", want: "ip:192.0.2.1"},
+		{key: "user", user: "alice", pass: "secret", want: "user:" + id},
+		{key: "user", user: "bob", pass: "secret", want: "user:" + id},
+		{key: "user", header: http.Header{"Authorization": {"Bearer secret"}}, want: "user:" + id},
+		// Unverified users are identified by their address.
+		{key: "user", user: "alice", pass: "guess", want: "ip:192.0.2.1"},
+		{key: "user", user: "alice", want: "ip:192.0.2.1"},
+	} {
+		l := NewRateLimiter(&RateLimitOptions{Key: tt.key, Identify: u.Identity})
+		r := httptest.NewRequest(http.MethodGet, "/example.com/m/@v/list", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for k, v := range tt.header {
+			r.Header[k] = v
+		}
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		if got := l.client(r); got != tt.want {
+			t.Errorf("key %s, header %v, user %q: got client %q, want %q", tt.key, tt.header, tt.user, got, tt.want)
+		}
+	}
+	if id == "" || id == "token:secret" {
+		t.Errorf("got identity %q, want a digest of the token", id)
+	}
+}
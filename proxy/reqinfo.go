@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// Modes in which a request is answered, as reported by RequestInfo.Mode.
+const (
+	ModeCached    = "cached"
+	ModeProxy     = "proxy"
+	ModeDirect    = "direct"
+	ModeSumDB     = "sumdb"
+	ModeNegative  = "negative"
+	ModeThrottled = "throttled"
+	ModeUpload    = "upload"
+	ModeMerged    = "merged"
+)
+
+// A RequestInfo collects facts about a module proxy request
+// for access logs and metrics.
+type RequestInfo struct {
+	Module  string
+	Version string
+	Kind    string // artifact kind, like KindZip
+	Mode    string // how the request was answered, like ModeCached
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a shallow copy of r carrying a new RequestInfo,
+// which the handlers of this package fill in while serving the request.
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	info := new(RequestInfo)
+	info.Module, info.Version, info.Kind = parseRequestPath(r.URL.Path)
+	if strings.HasPrefix(r.URL.Path, "/sumdb/") {
+		info.Mode = ModeSumDB
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// GetRequestInfo returns the RequestInfo carried by r, or nil.
+func GetRequestInfo(r *http.Request) *RequestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// setMode records the mode in which r is answered.
+func setMode(r *http.Request, mode string) {
+	if info := GetRequestInfo(r); info != nil {
+		info.Mode = mode
+	}
+}
+
+// setDefaultMode records the mode in which r is answered,
+// unless a handler wrapping this one recorded it already.
+func setDefaultMode(r *http.Request, mode string) {
+	if info := GetRequestInfo(r); info != nil && info.Mode == "" {
+		info.Mode = mode
+	}
+}
+
+// parseRequestPath returns the module path, version and artifact kind
+// requested by the module proxy URL path p.
+// Unrecognized parts are returned empty.
+func parseRequestPath(p string) (mod, vers, kind string) {
+	kind = ArtifactKind(p)
+	if kind == "" {
+		return "", "", ""
+	}
+	i := strings.Index(p, "/@")
+	mod, err := module.UnescapePath(strings.TrimPrefix(p[:i], "/"))
+	if err != nil {
+		return "", "", ""
+	}
+	if kind == KindList || kind == KindLatest {
+		return mod, "", kind
+	}
+	what := strings.TrimPrefix(p[i+len("/@"):], "v/")
+	vers, err = module.UnescapeVersion(strings.TrimSuffix(what, path.Ext(what)))
+	if err != nil {
+		vers = ""
+	}
+	return mod, vers, kind
+}
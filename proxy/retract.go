@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// A ModuleStatus reports the retracted versions and the deprecation
+// of a module, as declared by the go.mod file of its latest version,
+// which is where the go command reads them from.
+type ModuleStatus struct {
+	Path       string
+	Version    string // version whose go.mod file was read
+	Deprecated string `json:",omitempty"`
+	Retracted  []Retraction
+}
+
+// A Retraction is a retract directive, covering the versions
+// from Low to High included.
+type Retraction struct {
+	Low       string
+	High      string
+	Rationale string `json:",omitempty"`
+}
+
+// IsRetracted reports whether the version v is retracted.
+func (s *ModuleStatus) IsRetracted(v string) bool {
+	for _, r := range s.Retracted {
+		if semver.Compare(r.Low, v) <= 0 && semver.Compare(v, r.High) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadModuleStatus returns the status of the module path,
+// reading the go.mod file of its latest version through ops.
+func ReadModuleStatus(ctx context.Context, ops ServerOps, path string) (*ModuleStatus, error) {
+	st, _, err := moduleStatus(ctx, ops, path)
+	return st, err
+}
+
+// moduleStatus returns the status and the listed versions of the module path.
+func moduleStatus(ctx context.Context, ops ServerOps, path string) (*ModuleStatus, []string, error) {
+	f, err := ops.List(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := strings.Fields(string(data))
+	latest := latestVersion(versions)
+	if latest == "" {
+		f, err := ops.Latest(ctx, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		latest, err = infoVersion(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	m := module.Version{Path: path, Version: latest}
+	f, err = ops.GoMod(ctx, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	mf, err := modfile.ParseLax("go.mod", data, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", m, err)
+	}
+	st := &ModuleStatus{Path: path, Version: latest, Retracted: []Retraction{}}
+	if mf.Module != nil {
+		st.Deprecated = mf.Module.Deprecated
+	}
+	for _, r := range mf.Retract {
+		st.Retracted = append(st.Retracted, Retraction{r.Low, r.High, r.Rationale})
+	}
+	return st, versions, nil
+}
+
+// infoVersion returns the version of the info file f, rewound.
+func infoVersion(f File) (string, error) {
+	var info struct{ Version string }
+	if err := json.NewDecoder(f).Decode(&info); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
+
+// ExcludeRetracted returns a ServerOps answering @latest with the highest
+// listed version not retracted by the module, when the latest version of
+// ops is retracted. The go command skips the retracted versions itself,
+// but backends like DirOps or Uploads do not.
+func ExcludeRetracted(ops ServerOps) ServerOps {
+	return retractOps{ops}
+}
+
+type retractOps struct {
+	ServerOps
+}
+
+// Latest returns the info file of the latest version not retracted,
+// or else of the latest version.
+func (o retractOps) Latest(ctx context.Context, path string) (File, error) {
+	f, err := o.ServerOps.Latest(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := infoVersion(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st, versions, err := moduleStatus(ctx, o.ServerOps, path)
+	if err != nil {
+		log.Printf("latest %s: reading retractions: %v", path, err)
+		return f, nil
+	}
+	if !st.IsRetracted(v) {
+		return f, nil
+	}
+	var allowed []string
+	for _, v := range versions {
+		if !st.IsRetracted(v) {
+			allowed = append(allowed, v)
+		}
+	}
+	latest := latestVersion(allowed)
+	if latest == "" {
+		return f, nil
+	}
+	f.Close()
+	return o.Info(ctx, module.Version{Path: path, Version: latest})
+}
+
+// ServeStatus answers GET /module?path=<module path>
+// with the JSON ModuleStatus of the module.
+func (s *Server) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, err := s.ops.NewContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveStatus(ctx, w, r, s.ops)
+}
+
+// ServeStatus answers GET /module?path=<module path> like Server.ServeStatus,
+// reading the go.mod files from the upstream proxy for the modules
+// not served directly.
+func (rt *Router) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	mod := r.URL.Query().Get("path")
+	switch {
+	case rt.proxy == nil || rt.Direct(mod):
+		rt.srv.ServeStatus(w, r)
+	case rt.merged != nil && rt.Merge(mod):
+		rt.merged.ServeStatus(w, r)
+	default:
+		serveStatus(r.Context(), w, r, upstreamOps{rt})
+	}
+}
+
+func serveStatus(ctx context.Context, w http.ResponseWriter, r *http.Request, ops ServerOps) {
+	mod := r.URL.Query().Get("path")
+	if err := module.CheckPath(mod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	st, err := ReadModuleStatus(ctx, ops, mod)
+	if err != nil {
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(st)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExcludeRetracted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-retract-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"example.com/m/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"example.com/m/@v/v1.0.0.mod":  "module example.com/m\n",
+		"example.com/m/@v/v1.1.0.info": `{"Version":"v1.1.0"}`,
+		"example.com/m/@v/v1.1.0.mod":  "module example.com/m\n",
+		"example.com/m/@v/v1.2.0.info": `{"Version":"v1.2.0"}`,
+		"example.com/m/@v/v1.2.0.mod": "// Deprecated: use example.com/n.\nmodule example.com/m\n\n" +
+			"retract [v1.1.0, v1.2.0] // broken\n",
+		"example.com/ok/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"example.com/ok/@v/v1.0.0.mod":  "module example.com/ok\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := NewServer(ExcludeRetracted(NewDirOps(dir)))
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/example.com/m/@latest", 200, `"Version":"v1.0.0"`},
+		{"/example.com/m/@v/list", 200, "v1.0.0\nv1.1.0\nv1.2.0\n"},
+		{"/example.com/ok/@latest", 200, `"Version":"v1.0.0"`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.path, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeStatus(w, httptest.NewRequest("GET", "/module?path=example.com/m", nil))
+	for _, want := range []string{`"Version": "v1.2.0"`, `"Deprecated": "use example.com/n."`, `"Low": "v1.1.0"`, `"High": "v1.2.0"`, `"Rationale": "broken"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("GET /module?path=example.com/m = %d %q, want %s", w.Code, w.Body.String(), want)
+		}
+	}
+	w = httptest.NewRecorder()
+	srv.ServeStatus(w, httptest.NewRequest("GET", "/module?path=example.com/missing", nil))
+	if w.Code != 404 {
+		t.Errorf("GET /module?path=example.com/missing = %d, want 404", w.Code)
+	}
+}
@@ -3,7 +3,9 @@ package proxy
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -19,7 +21,8 @@ import (
 	"github.com/goproxyio/goproxy/v2/renameio"
 	"github.com/goproxyio/goproxy/v2/sumdb"
 
-	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/mod/module"
 )
 
 // ListExpire list data expire data duration.
@@ -31,6 +34,11 @@ type RouterOptions struct {
 	Proxy        string
 	DownloadRoot string
 	CacheExpire  time.Duration
+	// Merge is the pattern of the module paths whose versions are
+	// served from both the upstream proxy and the direct source,
+	// with their version lists merged and @latest computed
+	// over the merged list.
+	Merge string
 }
 
 // A Router is the proxy HTTP server,
@@ -39,89 +47,153 @@ type RouterOptions struct {
 type Router struct {
 	opts         *RouterOptions
 	srv          *Server
+	merged       *Server
 	proxy        *httputil.ReverseProxy
+	transport    http.RoundTripper
+	client       *http.Client
 	pattern      string
 	downloadRoot string
 	cacheExpire  time.Duration
 }
 
-func (router *Router) customModResponse(r *http.Response) error {
+// maxRedirects is the maximum number of redirects followed
+// when fetching an artifact from the upstream proxy.
+const maxRedirects = 10
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// readBody reads the whole body of r, decompressing it if needed,
+// and replaces r.Body so that it can be sent to the client again.
+func readBody(r *http.Response) ([]byte, error) {
+	var buf []byte
 	var err error
-	if r.StatusCode == http.StatusOK {
-		var buf []byte
-		if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
-			gr, err := gzip.NewReader(r.Body)
-			if err != nil {
-				return err
-			}
-			defer gr.Close()
-			buf, err = ioutil.ReadAll(gr)
-			if err != nil {
-				return err
-			}
-			r.Header.Del("Content-Encoding")
-			// rewrite content-length header due to the decompressed data will be refilled in the body
-			r.Header.Set("Content-Length", fmt.Sprint(len(buf)))
-		} else {
-			buf, err = ioutil.ReadAll(r.Body)
-			if err != nil {
-				return err
-			}
+	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
 		}
-		r.Body = ioutil.NopCloser(bytes.NewReader(buf))
-		if buf != nil {
-			file := filepath.Join(router.opts.DownloadRoot, r.Request.URL.Path)
-			os.MkdirAll(path.Dir(file), os.ModePerm)
-			err = renameio.WriteFile(file, buf, 0666)
-			if err != nil {
-				return err
-			}
+		defer gr.Close()
+		buf, err = ioutil.ReadAll(gr)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Del("Content-Encoding")
+	} else {
+		buf, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
 		}
 	}
-	// support 302 status code.
-	if r.StatusCode == http.StatusFound {
-		loc := r.Header.Get("Location")
-		if loc == "" {
-			return fmt.Errorf("%d response missing Location header", r.StatusCode)
+	r.Body.Close()
+	// rewrite content-length header due to the decompressed data will be refilled in the body
+	r.Header.Set("Content-Length", fmt.Sprint(len(buf)))
+	r.ContentLength = int64(len(buf))
+	r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	return buf, nil
+}
+
+// cacheFile stores the body fetched for the upstream request path p,
+// unless it is a .mod or .zip file differing from the one served before.
+func (router *Router) cacheFile(p string, buf []byte) error {
+	if c := router.srv.Checksums; c != nil {
+		mod, vers, kind := parseRequestPath(p)
+		if (kind == KindMod || kind == KindZip) && vers == module.CanonicalVersion(vers) {
+			if err := c.VerifyData(module.Version{Path: mod, Version: vers}, kind, buf); err != nil {
+				return &upstreamError{"checksum", err}
+			}
 		}
+	}
+	file := filepath.Join(router.opts.DownloadRoot, p)
+	os.MkdirAll(path.Dir(file), os.ModePerm)
+	return renameio.WriteFile(file, buf, 0666)
+}
+
+// followRedirect fetches the target of the redirect response r
+// through the router's transport, following any further redirects.
+// The Location header is resolved relative to the request URL.
+func (router *Router) followRedirect(r *http.Response) (*http.Response, error) {
+	loc := r.Header.Get("Location")
+	if loc == "" {
+		return nil, fmt.Errorf("%d response missing Location header", r.StatusCode)
+	}
+	u, err := r.Request.URL.Parse(loc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Location header %q: %v", loc, err)
+	}
+	method := r.Request.Method
+	if method != http.MethodHead {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(r.Request.Context(), method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req, span := startSpan(req, "upstream.redirect", attribute.String("http.url", u.String()))
+	injectTrace(req)
+	resp, err := router.client.Do(req)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// An upstreamError is an error found in an upstream response,
+// counted in the upstream error metrics under reason.
+type upstreamError struct {
+	reason string
+	err    error
+}
+
+func (e *upstreamError) Error() string { return e.err.Error() }
+
+// errorHandler counts the failed upstream requests
+// and responds with an HTTP 502 error.
+func (router *Router) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	reason := "transport"
+	if ue, ok := err.(*upstreamError); ok {
+		reason = ue.reason
+	}
+	upstreamErrors.WithLabelValues(reason).Inc()
+	log.Printf("upstream error: %s: %v", r.URL, err)
+	w.WriteHeader(http.StatusBadGateway)
+}
 
-		// TODO: location is relative.
-		_, err := url.Parse(loc)
+func (router *Router) customModResponse(r *http.Response) error {
+	if r.StatusCode >= 500 {
+		upstreamErrors.WithLabelValues("status").Inc()
+	}
+	// support redirects, e.g. to a CDN or an object store.
+	if isRedirect(r.StatusCode) {
+		resp, err := router.followRedirect(r)
 		if err != nil {
-			return fmt.Errorf("failed to parse Location header %q: %v", loc, err)
+			return &upstreamError{"redirect", err}
 		}
-		resp, err := http.Get(loc)
+		r.Body.Close()
+		// Serve the final response under the original path.
+		r.Status = resp.Status
+		r.StatusCode = resp.StatusCode
+		r.Header = resp.Header
+		r.Body = resp.Body
+		r.ContentLength = resp.ContentLength
+	}
+	if r.StatusCode == http.StatusOK {
+		buf, err := readBody(r)
 		if err != nil {
-			return err
+			return &upstreamError{"read", err}
 		}
-		defer resp.Body.Close()
-
-		var buf []byte
-		if strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
-			gr, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				return err
-			}
-			defer gr.Close()
-			buf, err = ioutil.ReadAll(gr)
-			if err != nil {
-				return err
-			}
-			resp.Header.Del("Content-Encoding")
-		} else {
-			buf, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return err
-			}
-		}
-		resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
-		if buf != nil {
-			file := filepath.Join(router.opts.DownloadRoot, r.Request.URL.Path)
-			os.MkdirAll(path.Dir(file), os.ModePerm)
-			err = renameio.WriteFile(file, buf, 0666)
-			if err != nil {
-				return err
+		if r.Request.Method != http.MethodHead {
+			if err := validateArtifact(r.Request.URL.Path, buf); err != nil {
+				return &upstreamError{"invalid", fmt.Errorf("rejected %s: %v", r.Request.URL.Path, err)}
 			}
+			return router.cacheFile(r.Request.URL.Path, buf)
 		}
 	}
 	return nil
@@ -148,22 +220,63 @@ func NewRouter(srv *Server, opts *RouterOptions) *Router {
 		proxy.Director = func(r *http.Request) {
 			director(r)
 			r.Host = remote.Host
+			injectTrace(r)
 		}
 
 		rt.proxy = proxy
 
-		rt.proxy.Transport = &http.Transport{
+		rt.transport = &http.Transport{
 			Proxy:           http.ProxyFromEnvironment,
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
+		rt.client = &http.Client{
+			Transport: rt.transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				return nil
+			},
+		}
+		rt.proxy.Transport = rt.transport
 		rt.proxy.ModifyResponse = rt.customModResponse
+		rt.proxy.ErrorHandler = rt.errorHandler
 		rt.pattern = opts.Pattern
 		rt.downloadRoot = opts.DownloadRoot
 		rt.cacheExpire = opts.CacheExpire
+		if opts.Merge != "" && srv != nil {
+			merged := NewServer(mergedOps{Chain(upstreamOps{rt}, srv.ops)})
+			merged.Checksums = srv.Checksums
+			rt.merged = merged
+		}
 	}
 	return rt
 }
 
+// CheckUpstream checks that the upstream proxy answers,
+// with the client fetching the artifacts from it.
+func (rt *Router) CheckUpstream(ctx context.Context) error {
+	if rt.client == nil {
+		return errors.New("no upstream proxy")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rt.opts.Proxy, nil)
+	if err != nil {
+		return err
+	}
+	req, span := startSpan(req, "upstream.check", attribute.String("http.url", rt.opts.Proxy))
+	injectTrace(req)
+	resp, err := rt.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("upstream answered %s", resp.Status)
+		}
+	}
+	endSpan(span, err)
+	return err
+}
+
 // Direct decides whether a path should directly access.
 func (rt *Router) Direct(path string) bool {
 	if rt.pattern == "" {
@@ -172,56 +285,78 @@ func (rt *Router) Direct(path string) bool {
 	return GlobsMatchPath(rt.pattern, path)
 }
 
+// serveUpstream serves r from the upstream proxy.
+func (rt *Router) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	setMode(r, ModeProxy)
+	r, span := startSpan(r, "upstream", attribute.String("http.path", r.URL.Path))
+	defer span.End()
+	mw := NewMetricsResponseWriter(w)
+	rt.proxy.ServeHTTP(mw, r)
+	span.SetAttributes(attribute.Int("http.status_code", mw.statusCode))
+}
+
 // ServveHTTP implements http handler.
 func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	mw := NewMetricsResponseWriter(w)
+	r, span := startSpan(r, "Router.ServeHTTP", attribute.String("http.path", r.URL.Path))
+	defer func() {
+		if info := GetRequestInfo(r); info != nil {
+			span.SetAttributes(attribute.String("goproxy.mode", info.Mode))
+		}
+		span.End()
+	}()
+
 	// sumdb handler
 	if strings.HasPrefix(r.URL.Path, "/sumdb/") {
-		sumdb.Handler(mw, r)
-		totalRequest.With(prometheus.Labels{"mode": "sumdb", "status": mw.status()}).Inc()
+		setMode(r, ModeSumDB)
+		sumdb.Handler(w, r)
 		return
 	}
 
 	if rt.proxy == nil || rt.Direct(strings.TrimPrefix(r.URL.Path, "/")) {
-		log.Printf("------ --- %s [direct]\n", r.URL)
-		rt.srv.ServeHTTP(mw, r)
-		totalRequest.With(prometheus.Labels{"mode": "direct", "status": mw.status()}).Inc()
+		setMode(r, ModeDirect)
+		rt.srv.ServeHTTP(w, r)
+		return
+	}
+
+	if mod, _, _ := parseRequestPath(r.URL.Path); rt.merged != nil && mod != "" && rt.Merge(mod) {
+		setMode(r, ModeMerged)
+		rt.merged.ServeHTTP(w, r)
 		return
 	}
 
 	file := filepath.Join(rt.downloadRoot, r.URL.Path)
-	if info, err := os.Stat(file); err == nil {
+	_, lookup := startSpan(r, "cache.lookup")
+	info, err := os.Stat(file)
+	lookup.SetAttributes(attribute.Bool("goproxy.cache.hit", err == nil))
+	lookup.End()
+	if err == nil {
 		if f, err := os.Open(file); err == nil {
 			var ctype string
 			defer f.Close()
 			if strings.HasSuffix(r.URL.Path, "/@latest") {
 				if time.Since(info.ModTime()) >= ListExpire {
-					log.Printf("------ --- %s [proxy]\n", r.URL)
-					rt.proxy.ServeHTTP(mw, r)
-					totalRequest.With(prometheus.Labels{"mode": "proxy", "status": mw.status()}).Inc()
+					rt.serveUpstream(w, r)
 				} else {
 					ctype = "text/plain; charset=UTF-8"
-					mw.Header().Set("Content-Type", ctype)
-					log.Printf("------ --- %s [cached]\n", r.URL)
-					http.ServeContent(mw, r, "", info.ModTime(), f)
-					totalRequest.With(prometheus.Labels{"mode": "cached", "status": mw.status()}).Inc()
+					w.Header().Set("Content-Type", ctype)
+					setMode(r, ModeCached)
+					http.ServeContent(w, r, "", info.ModTime(), f)
 				}
 				return
 			}
 
 			i := strings.Index(r.URL.Path, "/@v/")
 			if i < 0 {
-				http.Error(mw, "no such path", http.StatusNotFound)
-				totalRequest.With(prometheus.Labels{"mode": "proxy", "status": mw.status()}).Inc()
+				setMode(r, ModeProxy)
+				http.Error(w, "no such path", http.StatusNotFound)
 				return
 			}
 
 			what := r.URL.Path[i+len("/@v/"):]
+			var kind string
 			if what == "list" {
 				if time.Since(info.ModTime()) >= rt.cacheExpire {
-					log.Printf("------ --- %s [proxy]\n", r.URL)
-					rt.proxy.ServeHTTP(mw, r)
-					totalRequest.With(prometheus.Labels{"mode": "proxy", "status": mw.status()}).Inc()
+					rt.serveUpstream(w, r)
 					return
 				}
 				ctype = "text/plain; charset=UTF-8"
@@ -232,25 +367,30 @@ func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					ctype = "application/json"
 				case ".mod":
 					ctype = "text/plain; charset=UTF-8"
+					kind = KindMod
 				case ".zip":
 					ctype = "application/octet-stream"
+					kind = KindZip
 				default:
-					http.Error(mw, "request not recognized", http.StatusNotFound)
-					totalRequest.With(prometheus.Labels{"mode": "proxy", "status": mw.status()}).Inc()
+					setMode(r, ModeProxy)
+					http.Error(w, "request not recognized", http.StatusNotFound)
 					return
 				}
 			}
-			mw.Header().Set("Content-Type", ctype)
-			log.Printf("------ --- %s [cached]\n", r.URL)
-			http.ServeContent(mw, r, "", info.ModTime(), f)
-			totalRequest.With(prometheus.Labels{"mode": "cached", "status": mw.status()}).Inc()
+			setMode(r, ModeCached)
+			if c := rt.srv.Checksums; c != nil && kind != "" {
+				mod, vers, _ := parseRequestPath(r.URL.Path)
+				if err := c.Verify(module.Version{Path: mod, Version: vers}, kind, f); err != nil {
+					http.Error(w, err.Error(), StatusCode(err))
+					return
+				}
+			}
+			w.Header().Set("Content-Type", ctype)
+			http.ServeContent(w, r, "", info.ModTime(), f)
 			return
 		}
 	}
-	log.Printf("------ --- %s [proxy]\n", r.URL)
-	rt.proxy.ServeHTTP(mw, r)
-	totalRequest.With(prometheus.Labels{"mode": "proxy", "status": mw.status()}).Inc()
-	return
+	rt.serveUpstream(w, r)
 }
 
 // GlobsMatchPath reports whether any path prefix of target
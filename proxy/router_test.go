@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouterRedirect(t *testing.T) {
+	const body = "module example.com/m\n"
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blob/hop":
+			// relative redirect inside the CDN
+			http.Redirect(w, r, "final", http.StatusTemporaryRedirect)
+		case "/blob/final":
+			w.Write([]byte(body))
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer cdn.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/m/@v/v1.0.0.mod":
+			http.Redirect(w, r, cdn.URL+"/blob/hop", http.StatusMovedPermanently)
+		case "/example.com/m/@v/v1.0.1.mod":
+			http.Redirect(w, r, cdn.URL+"/loop", http.StatusSeeOther)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "goproxy-router-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rt := NewRouter(NewServer(nil), &RouterOptions{
+		Proxy:        upstream.URL,
+		DownloadRoot: dir,
+	})
+
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/m/@v/v1.0.0.mod", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("chained redirect: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Body.String(); got != body {
+		t.Errorf("chained redirect: got body %q, want %q", got, body)
+	}
+	cached, err := ioutil.ReadFile(filepath.Join(dir, "example.com/m/@v/v1.0.0.mod"))
+	if err != nil {
+		t.Fatalf("redirected body not cached: %v", err)
+	}
+	if string(cached) != body {
+		t.Errorf("cached body %q, want %q", cached, body)
+	}
+
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/example.com/m/@v/v1.0.1.mod", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("redirect loop: got status %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com/m/@v/v1.0.1.mod")); !os.IsNotExist(err) {
+		t.Errorf("redirect loop: unexpected cache file, stat err %v", err)
+	}
+}
+
+func TestRouterCheckUpstream(t *testing.T) {
+	status := http.StatusOK
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer upstream.Close()
+
+	rt := NewRouter(NewServer(nil), &RouterOptions{Proxy: upstream.URL})
+	for _, tt := range []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNotFound, true},
+		{http.StatusBadGateway, false},
+	} {
+		status = tt.status
+		if err := rt.CheckUpstream(context.Background()); (err == nil) != tt.ok {
+			t.Errorf("upstream answering %d: CheckUpstream = %v", tt.status, err)
+		}
+	}
+	upstream.Close()
+	if err := rt.CheckUpstream(context.Background()); err == nil {
+		t.Error("CheckUpstream of a closed upstream succeeded")
+	}
+	if err := NewRouter(NewServer(nil), &RouterOptions{}).CheckUpstream(context.Background()); err == nil {
+		t.Error("CheckUpstream without upstream succeeded")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,8 +29,10 @@ type ServerOps interface {
 	NewContext(r *http.Request) (context.Context, error)
 	// List, Latest, Info, GoMod, and Zip all return a File to be sent to a client.
 	// The File will be closed after its contents are sent.
-	// In the case of an error, if the error satisfies errors.Is(err, os.ErrNotFound),
+	// In the case of an error, if the error satisfies errors.Is(err, os.ErrNotExist),
 	// the server responds with an HTTP 404 error;
+	// errors of the other kinds, like ErrGone or ErrForbidden,
+	// are mapped as described by StatusCode;
 	// otherwise it responds with an HTTP 500 error.
 	// List returns a list of tagged versions of the module identified by path.
 	// The versions should all be canonical semantic versions
@@ -108,6 +111,10 @@ type File interface {
 // The server will respond with an http.StatusBadRequest (400) error to unrecognized requests.
 type Server struct {
 	ops ServerOps
+
+	// Checksums, if not nil, verifies the .mod and .zip files
+	// served by the server and by the Routers using it.
+	Checksums *Checksums
 }
 
 // NewServer returns a new Server using the given operations.
@@ -125,9 +132,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// sumdb handler
 	if strings.HasPrefix(r.URL.Path, "/sumdb/") {
+		setMode(r, ModeSumDB)
 		sumdb.Handler(w, r)
 		return
 	}
+	setDefaultMode(r, ModeDirect)
 
 	i := strings.Index(r.URL.Path, "/@")
 	if i < 0 {
@@ -184,16 +193,21 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case ".mod":
 			ctype = "text/plain; charset=UTF-8"
 			f, openErr = s.ops.GoMod(ctx, m)
+			f, openErr = s.verify(m, KindMod, f, openErr)
 		case ".zip":
 			ctype = "application/octet-stream"
 			f, openErr = s.ops.Zip(ctx, m)
+			f, openErr = s.verify(m, KindZip, f, openErr)
 		default:
 			http.Error(w, "request not recognized", http.StatusNotFound)
 			return
 		}
 	}
 	if openErr != nil {
-		code := http.StatusNotFound
+		code := StatusCode(openErr)
+		if after, ok := RetryAfter(openErr); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(after.Seconds()+0.5)))
+		}
 		http.Error(w, openErr.Error(), code)
 		return
 	}
@@ -211,6 +225,19 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, what, info.ModTime(), f)
 }
 
+// verify checks the file f of kind KindMod or KindZip of m,
+// opened with the error err, against the recorded checksums.
+func (s *Server) verify(m module.Version, kind string, f File, err error) (File, error) {
+	if err != nil || s.Checksums == nil {
+		return f, err
+	}
+	if err := s.Checksums.Verify(m, kind, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
 // MemFile returns an File containing the given in-memory content and modification time.
 func MemFile(data []byte, t time.Time) File {
 	return &memFile{bytes.NewReader(data), memStat{t, int64(len(data))}}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/mod/module"
+)
+
+// ToolchainModule is the module path of the Go toolchains downloaded by
+// the go command when GOTOOLCHAIN allows switching toolchains,
+// with versions like v0.0.1-go1.22.0.linux-amd64.
+const ToolchainModule = "golang.org/toolchain"
+
+// ToolchainOptions configures the handling of the toolchain module.
+type ToolchainOptions struct {
+	// Allow lists the patterns, in path.Match syntax, of the toolchains
+	// served, matched against names like go1.22.0.linux-amd64.
+	// All the toolchains are served if Allow is empty.
+	Allow []string
+	// Retention is how long a toolchain version stays in the cache
+	// after its last request. Zero keeps them forever.
+	Retention time.Duration
+	// ExtractDir, if set, is the module cache in which the go command
+	// extracts the toolchain zips, also cleaned up after Retention.
+	ExtractDir string
+}
+
+// Toolchains serves the toolchain module, whose zip files are large,
+// with its own allow-list, cache retention and metrics.
+type Toolchains struct {
+	root string
+	opts ToolchainOptions
+
+	mu   sync.Mutex
+	used map[string]time.Time // last request per version
+}
+
+// NewToolchains returns a Toolchains for the download cache root.
+func NewToolchains(root string, opts *ToolchainOptions) *Toolchains {
+	t := &Toolchains{root: root, used: make(map[string]time.Time)}
+	if opts != nil {
+		t.opts = *opts
+	}
+	return t
+}
+
+// splitToolchain splits a version of the toolchain module into the
+// toolchain name, its go version and its platform, the last two being
+// empty if vers is not a toolchain version.
+func splitToolchain(vers string) (name, goVersion, platform string) {
+	name = strings.TrimPrefix(vers, "v0.0.1-")
+	i := strings.LastIndex(name, ".")
+	if name == vers || !strings.HasPrefix(name, "go") || i < 0 {
+		return vers, "", ""
+	}
+	return name, name[:i], name[i+1:]
+}
+
+// Allowed reports whether the toolchain named name is served.
+func (t *Toolchains) Allowed(name string) bool {
+	if len(t.opts.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range t.opts.Allow {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// otherToolchain labels the metrics of the toolchain versions
+// neither served nor cached, which clients can make up at will.
+const otherToolchain = "other"
+
+// Handler returns h wrapped so that the requests for the versions of the
+// toolchain module not allowed are refused, that these versions are left
+// out of its version list and latest version, and that the requests for
+// the toolchain module are counted by toolchain version and platform.
+func (t *Toolchains) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mod, vers, kind := parseRequestPath(r.URL.Path)
+		if mod != ToolchainModule {
+			h.ServeHTTP(w, r)
+			return
+		}
+		labels := prometheus.Labels{"version": "", "platform": "", "kind": kind}
+		mw := NewMetricsResponseWriter(w)
+		switch {
+		case vers == "":
+			if len(t.opts.Allow) > 0 && (kind == KindList || kind == KindLatest) {
+				t.serveAllowed(mw, r, h, kind)
+			} else {
+				h.ServeHTTP(mw, r)
+			}
+		default:
+			name, goVersion, platform := splitToolchain(vers)
+			if !t.Allowed(name) {
+				http.Error(mw, fmt.Sprintf("toolchain %s is not allowed by this proxy", name), http.StatusForbidden)
+			} else {
+				h.ServeHTTP(mw, r)
+			}
+			ok := mw.statusCode == 0 || mw.statusCode/100 == 2
+			if ok {
+				t.mu.Lock()
+				t.used[vers] = time.Now()
+				t.mu.Unlock()
+			}
+			if ok || t.cached(vers) {
+				labels["version"], labels["platform"] = goVersion, platform
+			} else {
+				labels["version"], labels["platform"] = otherToolchain, otherToolchain
+			}
+		}
+		labels["status"] = mw.status()
+		toolchainRequests.With(labels).Inc()
+	})
+}
+
+// serveAllowed answers the request r for the version list or the latest
+// version of the toolchain module, served by h, with the allowed versions.
+func (t *Toolchains) serveAllowed(w http.ResponseWriter, r *http.Request, h http.Handler, kind string) {
+	get := func(p string) *bufferedResponse {
+		r := r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = p, ""
+		b := newBufferedResponse()
+		h.ServeHTTP(b, r)
+		return b
+	}
+	list := "/" + ToolchainModule + "/@v/list"
+	if kind == KindList {
+		b := get(list)
+		if b.code == http.StatusOK {
+			b.body = t.filterList(b.body)
+		}
+		b.send(w)
+		return
+	}
+
+	b := get(r.URL.Path)
+	if b.code != http.StatusOK {
+		b.send(w)
+		return
+	}
+	if v, err := infoVersion(MemFile(b.body, time.Time{})); err == nil {
+		if name, _, _ := splitToolchain(v); t.Allowed(name) {
+			b.send(w)
+			return
+		}
+	}
+	b = get(list)
+	if b.code != http.StatusOK {
+		b.send(w)
+		return
+	}
+	latest := latestVersion(strings.Fields(string(t.filterList(b.body))))
+	if latest == "" {
+		http.Error(w, "no toolchain allowed by this proxy", http.StatusNotFound)
+		return
+	}
+	esc, err := module.EscapeVersion(latest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	get("/" + ToolchainModule + "/@v/" + esc + ".info").send(w)
+}
+
+// filterList returns the version list data without the versions not allowed.
+func (t *Toolchains) filterList(data []byte) []byte {
+	var buf bytes.Buffer
+	for _, v := range strings.Fields(string(data)) {
+		if name, _, _ := splitToolchain(v); t.Allowed(name) {
+			fmt.Fprintln(&buf, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// cached reports whether the toolchain version vers is in the cache.
+func (t *Toolchains) cached(vers string) bool {
+	esc, _ := module.EscapePath(ToolchainModule)
+	escVers, err := module.EscapeVersion(vers)
+	if err != nil {
+		return false
+	}
+	base := filepath.Join(t.root, filepath.FromSlash(esc), "@v", escVers)
+	for _, ext := range []string{".info", ".zip"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// A bufferedResponse holds a response in memory,
+// to be changed before it is sent.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   []byte
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), code: http.StatusOK}
+}
+
+// Header implements http.ResponseWriter.
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+// WriteHeader implements http.ResponseWriter.
+func (b *bufferedResponse) WriteHeader(code int) { b.code = code }
+
+// Write implements http.ResponseWriter.
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.body = append(b.body, p...)
+	return len(p), nil
+}
+
+// send writes the response to w.
+func (b *bufferedResponse) send(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	// The body may have changed.
+	w.Header().Del("Content-Length")
+	w.Header().Del("ETag")
+	w.WriteHeader(b.code)
+	w.Write(b.body)
+}
+
+// Watch removes the toolchain versions unused for longer than the
+// retention and updates the toolchain cache metrics every interval,
+// until stop is closed.
+func (t *Toolchains) Watch(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		t.sweep()
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweep removes the files of the toolchain versions unused for longer
+// than the retention, counting the versions not requested since the
+// process started from the first sweep seeing them.
+func (t *Toolchains) sweep() {
+	esc, _ := module.EscapePath(ToolchainModule)
+	dir := filepath.Join(t.root, filepath.FromSlash(esc), "@v")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		toolchainCacheBytes.Set(0)
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var size int64
+	evicted := make(map[string]bool)
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if ext != ".info" && ext != ".mod" && ext != ".zip" && ext != ".ziphash" {
+			size += fi.Size()
+			continue
+		}
+		vers, err := module.UnescapeVersion(strings.TrimSuffix(fi.Name(), ext))
+		if err != nil {
+			continue
+		}
+		used, ok := t.used[vers]
+		if !ok {
+			t.used[vers] = now
+			used = now
+		}
+		if t.opts.Retention > 0 && now.Sub(used) > t.opts.Retention {
+			if err := os.Remove(filepath.Join(dir, fi.Name())); err == nil || os.IsNotExist(err) {
+				evicted[vers] = true
+				continue
+			}
+		}
+		size += fi.Size()
+	}
+	for vers := range evicted {
+		delete(t.used, vers)
+		if t.opts.ExtractDir != "" {
+			escVers, _ := module.EscapeVersion(vers)
+			if err := removeModuleDir(filepath.Join(t.opts.ExtractDir, filepath.FromSlash(esc)+"@"+escVers)); err != nil {
+				log.Printf("evict toolchain %s: %v", vers, err)
+			}
+		}
+		log.Printf("toolchain %s evicted after %v unused", vers, t.opts.Retention)
+		toolchainEvicted.Inc()
+	}
+	toolchainCacheBytes.Set(float64(size))
+}
+
+// removeModuleDir removes the module directory dir,
+// which the go command makes read-only.
+func removeModuleDir(dir string) error {
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(p, 0777)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestToolchains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-toolchain-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdir := filepath.Join(dir, "download", "golang.org", "toolchain", "@v")
+	extracted := filepath.Join(dir, "golang.org", "toolchain@v0.0.1-go1.21.0.linux-amd64")
+	for _, d := range []string{vdir, extracted} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"v0.0.1-go1.21.0.linux-amd64.zip", "v0.0.1-go1.22.0.linux-amd64.zip", "list"} {
+		if err := ioutil.WriteFile(filepath.Join(vdir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(extracted, 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := NewToolchains(filepath.Join(dir, "download"), &ToolchainOptions{
+		Allow:      []string{"go1.22.*", "go1.21.0.linux-amd64"},
+		Retention:  time.Hour,
+		ExtractDir: dir,
+	})
+	h := tc.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/@v/list"):
+			w.Write([]byte("v0.0.1-go1.21.0.linux-amd64\nv0.0.1-go1.22.0.linux-amd64\nv0.0.1-go1.23.0.linux-amd64\n"))
+		case strings.HasSuffix(r.URL.Path, "/@latest"):
+			w.Write([]byte(`{"Version":"v0.0.1-go1.23.0.linux-amd64"}`))
+		case strings.HasSuffix(r.URL.Path, ".info"):
+			_, vers, _ := parseRequestPath(r.URL.Path)
+			w.Write([]byte(`{"Version":"` + vers + `"}`))
+		case strings.Contains(r.URL.Path, "go1.22.9"):
+			http.NotFound(w, r)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/golang.org/toolchain/@v/v0.0.1-go1.22.0.darwin-arm64.zip", 200, "ok"},
+		{"/golang.org/toolchain/@v/v0.0.1-go1.21.0.linux-amd64.info", 200, `{"Version":"v0.0.1-go1.21.0.linux-amd64"}`},
+		{"/golang.org/toolchain/@v/v0.0.1-go1.21.0.windows-amd64.zip", 403, ""},
+		{"/golang.org/toolchain/@v/v0.0.1-go1.20.linux-amd64.mod", 403, ""},
+		{"/golang.org/toolchain/@v/v0.0.1-go1.22.9.linux-amd64.zip", 404, ""},
+		{"/golang.org/toolchain/@v/list", 200, "v0.0.1-go1.21.0.linux-amd64\nv0.0.1-go1.22.0.linux-amd64\n"},
+		{"/golang.org/toolchain/@latest", 200, `{"Version":"v0.0.1-go1.22.0.linux-amd64"}`},
+		{"/example.com/m/@v/v1.0.0.zip", 200, "ok"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.path, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+
+	// Only the versions served or cached are remembered and labeled.
+	tc.mu.Lock()
+	for _, vers := range []string{"v0.0.1-go1.21.0.windows-amd64", "v0.0.1-go1.20.linux-amd64", "v0.0.1-go1.22.9.linux-amd64"} {
+		if _, ok := tc.used[vers]; ok {
+			t.Errorf("%s recorded as used", vers)
+		}
+	}
+	tc.mu.Unlock()
+	labels := toolchainLabels(t)
+	for _, want := range []string{"go1.22.0/darwin-arm64", "go1.21.0/linux-amd64", "other/other"} {
+		if !labels[want] {
+			t.Errorf("no requests labeled %s in %v", want, labels)
+		}
+	}
+	for _, unwanted := range []string{"go1.21.0/windows-amd64", "go1.20/linux-amd64", "go1.22.9/linux-amd64"} {
+		if labels[unwanted] {
+			t.Errorf("requests labeled %s", unwanted)
+		}
+	}
+
+	// go1.22.0 was never requested for linux-amd64: the first sweep
+	// starts its retention. go1.21.0 expires.
+	tc.sweep()
+	tc.mu.Lock()
+	tc.used["v0.0.1-go1.21.0.linux-amd64"] = time.Now().Add(-2 * time.Hour)
+	tc.mu.Unlock()
+	tc.sweep()
+	if _, err := os.Stat(filepath.Join(vdir, "v0.0.1-go1.21.0.linux-amd64.zip")); !os.IsNotExist(err) {
+		t.Errorf("expired toolchain zip not removed: %v", err)
+	}
+	if _, err := os.Stat(extracted); !os.IsNotExist(err) {
+		t.Errorf("expired toolchain directory not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(vdir, "v0.0.1-go1.22.0.linux-amd64.zip")); err != nil {
+		t.Errorf("toolchain zip removed before its retention: %v", err)
+	}
+}
+
+// toolchainLabels returns the version/platform label pairs
+// of the toolchain requests counted.
+func toolchainLabels(t *testing.T) map[string]bool {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]bool)
+	for _, mf := range mfs {
+		if mf.GetName() != "goproxy_toolchain_requests_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var version, platform string
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "version":
+					version = lp.GetValue()
+				case "platform":
+					platform = lp.GetValue()
+				}
+			}
+			labels[version+"/"+platform] = true
+		}
+	}
+	return labels
+}
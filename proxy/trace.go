@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of this package, using the global
+// OpenTelemetry tracer provider.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/goproxyio/goproxy/v2/proxy")
+}
+
+// startSpan starts a span named name as a child of the span of r,
+// and returns r with the new span in its context.
+func startSpan(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx, span := tracer().Start(r.Context(), name, trace.WithAttributes(attrs...))
+	return r.WithContext(ctx), span
+}
+
+// injectTrace propagates the span of r to the upstream in the
+// W3C traceparent header.
+func injectTrace(r *http.Request) {
+	otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
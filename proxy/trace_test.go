@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRouterTrace(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	defer tp.Shutdown(context.Background())
+	oldTP, oldProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(oldTP)
+		otel.SetTextMapPropagator(oldProp)
+	}()
+
+	var traceparents []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("Traceparent"))
+		if r.URL.Path == "/example.com/m/@v/v1.0.0.mod" {
+			http.Redirect(w, r, "/blob", http.StatusFound)
+			return
+		}
+		w.Write([]byte("module example.com/m\n"))
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "goproxy-trace-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rt := NewRouter(NewServer(nil), &RouterOptions{Proxy: upstream.URL, DownloadRoot: dir})
+	ctx, root := tp.Tracer("test").Start(context.Background(), "root")
+	req := httptest.NewRequest(http.MethodGet, "/example.com/m/@v/v1.0.0.mod", nil).WithContext(ctx)
+	rt.ServeHTTP(httptest.NewRecorder(), req)
+	root.End()
+
+	traceID := root.SpanContext().TraceID().String()
+	if len(traceparents) != 2 {
+		t.Fatalf("upstream got %d requests, want 2", len(traceparents))
+	}
+	for _, tp := range traceparents {
+		if !strings.Contains(tp, traceID) {
+			t.Errorf("upstream traceparent %q does not carry trace %s", tp, traceID)
+		}
+	}
+
+	var names []string
+	for _, s := range rec.Ended() {
+		if s.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %s in trace %s, want %s", s.Name(), s.SpanContext().TraceID(), traceID)
+		}
+		names = append(names, s.Name())
+	}
+	sort.Strings(names)
+	want := []string{"Router.ServeHTTP", "cache.lookup", "root", "upstream", "upstream.redirect"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("spans = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,453 @@
+package proxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/renameio"
+	"github.com/goproxyio/goproxy/v2/robustio"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// maxUploadMeta bounds the size of an uploaded .info or .mod file.
+const maxUploadMeta = modzip.MaxGoMod
+
+// Uploads stores module versions published with the upload API,
+// and serves them as a ServerOps:
+//
+//	PUT /example.com/m/@v/v1.0.0.info  (optional)
+//	PUT /example.com/m/@v/v1.0.0.mod   (optional)
+//	PUT /example.com/m/@v/v1.0.0.zip
+//
+// The .info and .mod files, if any, are staged until the zip file
+// is uploaded, which publishes the version. Missing files are derived
+// from the zip file and the upload time. A published version is
+// immutable: uploading different contents for it fails with
+// ErrConflict, while uploading the same contents again succeeds.
+// Uploading a version known from another source, found in Cache or
+// recorded by Checksums, fails with ErrConflict as well.
+//
+// The files are kept in dir in the layout of a GOPROXY file:// tree.
+type Uploads struct {
+	dir    string
+	tokens [][]byte
+
+	// Published, if not nil, is called after a version is published.
+	Published func(m module.Version)
+	// Cache, if set, is a download cache whose versions
+	// cannot be uploaded.
+	Cache string
+	// Checksums, if not nil, records the versions served already,
+	// which cannot be uploaded.
+	Checksums *Checksums
+
+	mu sync.Mutex // serializes publication
+}
+
+// NewUploads returns Uploads storing files in dir, accepting
+// requests authenticated by one of the tokens, either as a bearer
+// token or as the basic authentication password.
+func NewUploads(dir string, tokens []string) *Uploads {
+	u := &Uploads{dir: dir}
+	for _, t := range tokens {
+		u.tokens = append(u.tokens, []byte(t))
+	}
+	return u
+}
+
+// Handler returns h wrapped so that PUT requests are answered
+// by the upload API.
+func (u *Uploads) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			h.ServeHTTP(w, r)
+			return
+		}
+		setMode(r, ModeUpload)
+		if !u.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goproxy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mod, vers, kind := parseRequestPath(r.URL.Path)
+		if mod == "" || (kind != KindInfo && kind != KindMod && kind != KindZip) {
+			http.Error(w, "upload must name a .info, .mod or .zip file", http.StatusBadRequest)
+			return
+		}
+		m := module.Version{Path: mod, Version: vers}
+		if err := module.Check(mod, vers); err != nil || vers != module.CanonicalVersion(vers) {
+			http.Error(w, fmt.Sprintf("invalid module version %s@%s", mod, vers), http.StatusBadRequest)
+			return
+		}
+		created, err := u.put(m, kind, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+}
+
+// authorized reports whether r carries one of the upload tokens.
+func (u *Uploads) authorized(r *http.Request) bool {
+	return u.token(r) != nil
+}
+
+// Identity returns an identity of the client sending r, derived from
+// its upload token, and false if r does not carry one of the tokens.
+// The identity does not reveal the token.
+func (u *Uploads) Identity(r *http.Request) (string, bool) {
+	t := u.token(r)
+	if t == nil {
+		return "", false
+	}
+	sum := sha256.Sum256(t)
+	return fmt.Sprintf("token:%x", sum[:8]), true
+}
+
+// token returns the upload token carried by r, or nil.
+func (u *Uploads) token(r *http.Request) []byte {
+	var token string
+	if _, pass, ok := r.BasicAuth(); ok {
+		token = pass
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return nil
+	}
+	for _, t := range u.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), t) == 1 {
+			return t
+		}
+	}
+	return nil
+}
+
+// put stores the uploaded file of the given kind for m,
+// reporting whether it was not stored already.
+func (u *Uploads) put(m module.Version, kind string, body io.Reader) (created bool, err error) {
+	dir, err := u.versionDir(m.Path)
+	if err != nil {
+		return false, NewError(ErrInvalidArtifact, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	base, err := u.base(m)
+	if err != nil {
+		return false, NewError(ErrInvalidArtifact, err)
+	}
+	if kind == KindZip {
+		return u.putZip(m, base, body)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxUploadMeta+1))
+	if err != nil {
+		return false, err
+	}
+	if len(data) > maxUploadMeta {
+		return false, NewError(ErrInvalidArtifact, fmt.Errorf("%s file too large", kind))
+	}
+	if kind == KindInfo {
+		err = validateInfo(data, m.Version)
+	} else {
+		err = validateGoMod(data, m.Path)
+	}
+	if err != nil {
+		return false, NewError(ErrInvalidArtifact, err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	file := base + "." + kind
+	if u.published(base) {
+		return false, sameContents(m, file, bytes.NewReader(data))
+	}
+	if err := u.checkUnknown(m); err != nil {
+		return false, err
+	}
+	return true, renameio.WriteFile(file, data, 0644)
+}
+
+// putZip validates and publishes the uploaded zip file of m.
+func (u *Uploads) putZip(m module.Version, base string, body io.Reader) (created bool, err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(base), filepath.Base(base)+".zip*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(body, modzip.MaxZipFile+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	if n > modzip.MaxZipFile {
+		return false, NewError(ErrInvalidArtifact, fmt.Errorf("zip file too large"))
+	}
+	if _, err := modzip.CheckZip(m, tmp.Name()); err != nil {
+		return false, NewError(ErrInvalidArtifact, err)
+	}
+	zipGoMod, err := readZipGoMod(m, tmp.Name())
+	if err != nil {
+		return false, NewError(ErrInvalidArtifact, err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.published(base) {
+		f, err := os.Open(tmp.Name())
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		return false, sameContents(m, base+".zip", f)
+	}
+	if err := u.checkUnknown(m); err != nil {
+		return false, err
+	}
+
+	goMod, err := ioutil.ReadFile(base + ".mod")
+	switch {
+	case os.IsNotExist(err):
+		goMod = zipGoMod
+		if goMod == nil {
+			goMod = []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(m.Path)))
+		}
+		if err := renameio.WriteFile(base+".mod", goMod, 0644); err != nil {
+			return false, err
+		}
+	case err != nil:
+		return false, err
+	case zipGoMod != nil && !bytes.Equal(goMod, zipGoMod):
+		return false, NewError(ErrInvalidArtifact, fmt.Errorf("go.mod in zip file differs from uploaded .mod file"))
+	}
+	if _, err := os.Stat(base + ".info"); os.IsNotExist(err) {
+		info, err := ioutil.ReadAll(NewInfo(m.Version, time.Now().UTC()))
+		if err != nil {
+			return false, err
+		}
+		if err := renameio.WriteFile(base+".info", info, 0644); err != nil {
+			return false, err
+		}
+	}
+	// The zip file is written last: its presence publishes the version.
+	if err := robustio.Rename(tmp.Name(), base+".zip"); err != nil {
+		return false, err
+	}
+	if u.Published != nil {
+		u.Published(m)
+	}
+	return true, nil
+}
+
+// checkUnknown returns an ErrConflict error if m is known from
+// another source than the uploads.
+func (u *Uploads) checkUnknown(m module.Version) error {
+	if u.Checksums != nil && u.Checksums.Recorded(m) {
+		return NewError(ErrConflict, fmt.Errorf("%s is already served", m))
+	}
+	if u.Cache == "" {
+		return nil
+	}
+	esc, err := module.EscapePath(m.Path)
+	if err != nil {
+		return err
+	}
+	escVers, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return err
+	}
+	base := filepath.Join(u.Cache, filepath.FromSlash(esc), "@v", escVers)
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return NewError(ErrConflict, fmt.Errorf("%s is already served", m))
+		}
+	}
+	return nil
+}
+
+// readZipGoMod returns the go.mod file in the module zip file,
+// or nil if there is none.
+func readZipGoMod(m module.Version, file string) ([]byte, error) {
+	z, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	name := m.Path + "@" + m.Version + "/go.mod"
+	for _, f := range z.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(io.LimitReader(rc, maxUploadMeta))
+	}
+	return nil, nil
+}
+
+// sameContents returns nil if the file has the contents of r,
+// and an ErrConflict error otherwise.
+func sameContents(m module.Version, file string, r io.Reader) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return NewError(ErrConflict, fmt.Errorf("%s is already published", m))
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h1, h2 := sha256.New(), sha256.New()
+	if _, err := io.Copy(h1, f); err != nil {
+		return err
+	}
+	if _, err := io.Copy(h2, r); err != nil {
+		return err
+	}
+	if !bytes.Equal(h1.Sum(nil), h2.Sum(nil)) {
+		return NewError(ErrConflict, fmt.Errorf("%s is already published with different %s", m, filepath.Ext(file)))
+	}
+	return nil
+}
+
+// open opens the file of a published version with the given
+// extension, like ".zip".
+func (u *Uploads) open(m module.Version, ext string) (File, error) {
+	base, err := u.base(m)
+	if err != nil {
+		return nil, NewError(ErrNotFound, err)
+	}
+	if !u.published(base) {
+		return nil, NewError(ErrNotFound, fmt.Errorf("%s not uploaded", m))
+	}
+	return os.Open(base + ext)
+}
+
+// Versions returns the published versions of the module mod,
+// in semantic version order.
+func (u *Uploads) Versions(mod string) ([]string, error) {
+	dir, err := u.versionDir(mod)
+	if err != nil {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".zip") {
+			continue
+		}
+		vers, err := module.UnescapeVersion(strings.TrimSuffix(fi.Name(), ".zip"))
+		if err == nil && vers == module.CanonicalVersion(vers) {
+			versions = append(versions, vers)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+	return versions, nil
+}
+
+// NewContext returns the request context.
+func (u *Uploads) NewContext(r *http.Request) (context.Context, error) {
+	return r.Context(), nil
+}
+
+// List lists the published versions of the module.
+func (u *Uploads) List(ctx context.Context, mod string) (File, error) {
+	versions, err := u.Versions(mod)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, NewError(ErrNotFound, fmt.Errorf("%s not uploaded", mod))
+	}
+	return MemFile(mergeVersions(versions), time.Time{}), nil
+}
+
+// Latest opens the info file of the highest published version
+// of the module, preferring releases over pre-releases
+// and pre-releases over pseudo-versions.
+func (u *Uploads) Latest(ctx context.Context, mod string) (File, error) {
+	versions, err := u.Versions(mod)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, NewError(ErrNotFound, fmt.Errorf("%s not uploaded", mod))
+	}
+	return u.open(module.Version{Path: mod, Version: latestVersion(versions)}, ".info")
+}
+
+// Info opens the info file of a published version.
+func (u *Uploads) Info(ctx context.Context, m module.Version) (File, error) {
+	return u.open(m, ".info")
+}
+
+// GoMod opens the go.mod file of a published version.
+func (u *Uploads) GoMod(ctx context.Context, m module.Version) (File, error) {
+	return u.open(m, ".mod")
+}
+
+// Zip opens the zip file of a published version.
+func (u *Uploads) Zip(ctx context.Context, m module.Version) (File, error) {
+	return u.open(m, ".zip")
+}
+
+// published reports whether the version with the files base.* is published.
+func (u *Uploads) published(base string) bool {
+	_, err := os.Stat(base + ".zip")
+	return err == nil
+}
+
+// versionDir returns the @v directory of the module mod.
+func (u *Uploads) versionDir(mod string) (string, error) {
+	esc, err := module.EscapePath(mod)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.dir, filepath.FromSlash(esc), "@v"), nil
+}
+
+// base returns the path of the files of m, without extension.
+func (u *Uploads) base(m module.Version) (string, error) {
+	dir, err := u.versionDir(m.Path)
+	if err != nil {
+		return "", err
+	}
+	escVers, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, escVers), nil
+}
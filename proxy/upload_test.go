@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func TestUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	makeZip := func(m module.Version, files ...modzip.File) []byte {
+		var buf bytes.Buffer
+		if err := modzip.Create(&buf, m, files); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	m := module.Version{Path: "example.com/m", Version: "v1.0.0"}
+	zip := makeZip(m, memZipFile{"go.mod", "module example.com/m\n"}, memZipFile{"m.go", "package m\n"})
+	otherZip := makeZip(m, memZipFile{"go.mod", "module example.com/m\n"}, memZipFile{"m.go", "package m // changed\n"})
+
+	u := NewUploads(dir, []string{"secret"})
+	var published []module.Version
+	u.Published = func(m module.Version) { published = append(published, m) }
+	h := u.Handler(http.NotFoundHandler())
+	put := func(p, token string, data []byte) int {
+		r := httptest.NewRequest(http.MethodPut, p, bytes.NewReader(data))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	tests := []struct {
+		path  string
+		token string
+		data  []byte
+		code  int
+	}{
+		{"/example.com/m/@v/v1.0.0.zip", "", zip, http.StatusUnauthorized},
+		{"/example.com/m/@v/v1.0.0.zip", "wrong", zip, http.StatusUnauthorized},
+		{"/example.com/m/@v/v1.0.0.zip", "secret", zip[:len(zip)/2], http.StatusBadRequest},
+		{"/example.com/m/@v/v1.0.1.zip", "secret", zip, http.StatusBadRequest},
+		{"/example.com/m/@v/master.zip", "secret", zip, http.StatusBadRequest},
+		{"/example.com/m/@v/v1.0.0.mod", "secret", []byte("module example.com/other\n"), http.StatusBadRequest},
+		{"/example.com/m/@v/v1.0.0.info", "secret", []byte(`{"Version":"v1.0.0","Time":"2020-01-01T00:00:00Z"}`), http.StatusCreated},
+		{"/example.com/m/@v/v1.0.0.mod", "secret", []byte("module example.com/m // staged\n"), http.StatusCreated},
+		// The staged go.mod must match the one in the zip file.
+		{"/example.com/m/@v/v1.0.0.zip", "secret", zip, http.StatusBadRequest},
+		{"/example.com/m/@v/v1.0.0.mod", "secret", []byte("module example.com/m\n"), http.StatusCreated},
+		{"/example.com/m/@v/v1.0.0.zip", "secret", zip, http.StatusCreated},
+		// Published versions are immutable, but uploads can be retried.
+		{"/example.com/m/@v/v1.0.0.zip", "secret", zip, http.StatusOK},
+		{"/example.com/m/@v/v1.0.0.zip", "secret", otherZip, http.StatusConflict},
+		{"/example.com/m/@v/v1.0.0.mod", "secret", []byte("module example.com/m // changed\n"), http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if code := put(tt.path, tt.token, tt.data); code != tt.code {
+			t.Errorf("PUT %s (token %q, %d bytes): status %d, want %d", tt.path, tt.token, len(tt.data), code, tt.code)
+		}
+	}
+	if len(published) != 1 || published[0] != m {
+		t.Errorf("published = %v, want [%v]", published, m)
+	}
+
+	// A zip file alone publishes a version, with derived .mod and .info files.
+	m2 := module.Version{Path: "example.com/m", Version: "v1.1.0-pre"}
+	if code := put("/example.com/m/@v/v1.1.0-pre.zip", "secret", makeZip(m2, memZipFile{"m.go", "package m\n"})); code != http.StatusCreated {
+		t.Fatalf("PUT zip only: status %d", code)
+	}
+	f, err := u.GoMod(context.Background(), m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(data) != "module example.com/m\n" {
+		t.Errorf("derived go.mod = %q", data)
+	}
+
+	versions, err := u.Versions("example.com/m")
+	if err != nil || len(versions) != 2 || versions[0] != "v1.0.0" || versions[1] != "v1.1.0-pre" {
+		t.Errorf("Versions = %v, %v", versions, err)
+	}
+	f, err = u.Latest(context.Background(), "example.com/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(f)
+	f.Close()
+	if !bytes.Contains(data, []byte(`"v1.0.0"`)) {
+		t.Errorf("Latest = %s, want the v1.0.0 release", data)
+	}
+	if _, err := u.Info(context.Background(), module.Version{Path: "example.com/m", Version: "v2.0.0"}); StatusCode(err) != http.StatusNotFound {
+		t.Errorf("Open unpublished version: %v", err)
+	}
+}
+
+func TestUploadsKnownVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "cache")
+	if err := os.MkdirAll(filepath.Join(cache, "example.com/!m/@v"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cache, "example.com/!m/@v/v1.0.0.info"), []byte(`{"Version":"v1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sums, err := OpenChecksums(filepath.Join(dir, "checksums.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sums.Close()
+	if err := sums.VerifyData(module.Version{Path: "example.com/M", Version: "v1.1.0"}, KindMod, []byte("module example.com/M\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	u := NewUploads(filepath.Join(dir, "uploads"), []string{"secret"})
+	u.Cache = cache
+	u.Checksums = sums
+	h := u.Handler(http.NotFoundHandler())
+	for _, tt := range []struct {
+		vers string
+		code int
+	}{
+		{"v1.0.0", http.StatusConflict}, // in the download cache
+		{"v1.1.0", http.StatusConflict}, // recorded by the checksums
+		{"v1.2.0", http.StatusCreated},
+		{"v1.2.0", http.StatusOK}, // uploaded already
+	} {
+		m := module.Version{Path: "example.com/M", Version: tt.vers}
+		var buf bytes.Buffer
+		if err := modzip.Create(&buf, m, []modzip.File{memZipFile{"go.mod", "module example.com/M\n"}}); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPut, "/example.com/!m/@v/"+tt.vers+".zip", &buf)
+		r.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.code {
+			t.Errorf("PUT %s: status %d, want %d: %s", m, rec.Code, tt.code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// validateArtifact checks that buf is a well-formed artifact
+// for the module proxy request path p, so that error pages and
+// truncated bodies returned by an upstream are never cached.
+// Paths that do not name a .info, .mod or .zip file
+// (or @latest) are not checked.
+func validateArtifact(p string, buf []byte) error {
+	i := strings.Index(p, "/@")
+	if i < 0 {
+		return nil
+	}
+	modPath, err := module.UnescapePath(strings.TrimPrefix(p[:i], "/"))
+	if err != nil {
+		return err
+	}
+	what := p[i+len("/@"):]
+	if what == "latest" {
+		return validateInfo(buf, "")
+	}
+	if !strings.HasPrefix(what, "v/") || what == "v/list" {
+		return nil
+	}
+	what = strings.TrimPrefix(what, "v/")
+	ext := path.Ext(what)
+	vers, err := module.UnescapeVersion(strings.TrimSuffix(what, ext))
+	if err != nil {
+		return err
+	}
+	switch ext {
+	case ".info":
+		// Info accepts arbitrary revisions, which resolve to another version.
+		if vers != module.CanonicalVersion(vers) {
+			vers = ""
+		}
+		return validateInfo(buf, vers)
+	case ".mod":
+		return validateGoMod(buf, modPath)
+	case ".zip":
+		return validateZip(buf, module.Version{Path: modPath, Version: vers})
+	}
+	return nil
+}
+
+// validateInfo checks that buf is an info file with a canonical version,
+// matching vers if vers is not empty.
+func validateInfo(buf []byte, vers string) error {
+	var info struct {
+		Version string
+	}
+	if err := json.Unmarshal(buf, &info); err != nil {
+		return fmt.Errorf("invalid info file: %v", err)
+	}
+	if info.Version == "" || info.Version != module.CanonicalVersion(info.Version) {
+		return fmt.Errorf("invalid info file: version %q is not in canonical form", info.Version)
+	}
+	if vers != "" && info.Version != vers {
+		return fmt.Errorf("invalid info file: asked for %s but got %s", vers, info.Version)
+	}
+	return nil
+}
+
+// validateGoMod checks that buf is a go.mod file declaring modPath.
+func validateGoMod(buf []byte, modPath string) error {
+	f, err := modfile.ParseLax("go.mod", buf, nil)
+	if err != nil {
+		return fmt.Errorf("invalid go.mod file: %v", err)
+	}
+	if f.Module == nil {
+		return fmt.Errorf("invalid go.mod file: missing module declaration")
+	}
+	if f.Module.Mod.Path != modPath {
+		return fmt.Errorf("invalid go.mod file: asked for %s but got %s", modPath, f.Module.Mod.Path)
+	}
+	return nil
+}
+
+// validateZip checks that buf is a module zip file for m.
+func validateZip(buf []byte, m module.Version) error {
+	f, err := ioutil.TempFile("", "goproxy-zip-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := modzip.CheckZip(m, f.Name()); err != nil {
+		return fmt.Errorf("invalid zip file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+type memZipFile struct {
+	path, data string
+}
+
+func (f memZipFile) Path() string                { return f.path }
+func (f memZipFile) Lstat() (os.FileInfo, error) { return &memStat{size: int64(len(f.data))}, nil }
+func (f memZipFile) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(f.data)), nil
+}
+
+func TestValidateArtifact(t *testing.T) {
+	var zip bytes.Buffer
+	m := module.Version{Path: "example.com/m", Version: "v1.0.0"}
+	files := []modzip.File{memZipFile{"go.mod", "module example.com/m\n"}}
+	if err := modzip.Create(&zip, m, files); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		data  string
+		valid bool
+	}{
+		{"/example.com/m/@v/v1.0.0.info", `{"Version":"v1.0.0","Time":"2020-01-01T00:00:00Z"}`, true},
+		{"/example.com/m/@v/master.info", `{"Version":"v0.0.0-20200101000000-abcdefabcdef"}`, true},
+		{"/example.com/m/@v/v1.0.0.info", `{"Version":"v1.0.1"}`, false},
+		{"/example.com/m/@v/v1.0.0.info", `<html>502 Bad Gateway</html>`, false},
+		{"/example.com/m/@latest", `{"Version":"1.0"}`, false},
+		{"/example.com/m/@v/v1.0.0.mod", "module example.com/m\n", true},
+		{"/example.com/m/@v/v1.0.0.mod", "module example.com/other\n", false},
+		{"/example.com/m/@v/v1.0.0.mod", "<html></html>\n", false},
+		{"/example.com/m/@v/v1.0.0.zip", zip.String(), true},
+		{"/example.com/m/@v/v1.0.0.zip", zip.String()[:zip.Len()/2], false},
+		{"/example.com/m/@v/v1.0.1.zip", zip.String(), false},
+		{"/example.com/m/@v/list", "v1.0.0\n", true},
+	}
+	for _, tt := range tests {
+		err := validateArtifact(tt.path, []byte(tt.data))
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("validateArtifact(%s, %.20q): valid = %v, want %v (err %v)", tt.path, tt.data, valid, tt.valid, err)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+	"github.com/goproxyio/goproxy/v2/renameio"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// A rewriteRule maps the modules under a path prefix to a git repository,
+// bypassing the resolution of their import paths.
+type rewriteRule struct {
+	prefix string // module path prefix, like go.corp.example/x
+	repo   string // git repository URL
+	subdir string // directory of the prefix in the repository
+}
+
+// rewrites is the table read from the -rewrite file,
+// longest prefixes first.
+var rewrites []rewriteRule
+
+// readRewrites reads a rewrite table from file, made of lines
+//
+//	<module path prefix> <git repository URL> [<subdirectory>]
+//
+// ignoring blank lines and lines starting with #.
+func readRewrites(file string) ([]rewriteRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []rewriteRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want <module path prefix> <repository URL> [<subdirectory>]", file, n)
+		}
+		if err := module.CheckImportPath(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		rule := rewriteRule{prefix: fields[0], repo: fields[1]}
+		if len(fields) == 3 {
+			rule.subdir = strings.Trim(path.Clean(fields[2]), "/")
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	return rules, nil
+}
+
+// lookupRewrite returns the rule for the module or import path p.
+func lookupRewrite(p string) (rewriteRule, bool) {
+	for _, rule := range rewrites {
+		if p == rule.prefix || strings.HasPrefix(p, rule.prefix+"/") {
+			return rule, true
+		}
+	}
+	return rewriteRule{}, false
+}
+
+// A vcsModule locates a module of the rewrite table in its repository.
+type vcsModule struct {
+	repo      string
+	tagPrefix string // prefix of the version tags, like "sub/"
+	dir       string // directory of the module, without major version suffix
+	pathMajor string // major version suffix of the module path, like "/v2"
+}
+
+func findVCSModule(mod string) (*vcsModule, bool) {
+	rule, ok := lookupRewrite(mod)
+	if !ok {
+		return nil, false
+	}
+	prefix, pathMajor, ok := module.SplitPathVersion(mod)
+	if !ok || len(prefix) < len(rule.prefix) {
+		return nil, false
+	}
+	dir := path.Join(rule.subdir, strings.TrimPrefix(prefix[len(rule.prefix):], "/"))
+	m := &vcsModule{repo: rule.repo, dir: dir, pathMajor: pathMajor}
+	if dir != "" {
+		m.tagPrefix = dir + "/"
+	}
+	return m, true
+}
+
+// tag returns the name of the tag of the version v of the module.
+func (m *vcsModule) tag(v string) string {
+	return m.tagPrefix + strings.TrimSuffix(v, "+incompatible")
+}
+
+// vcsOps is a proxy.ServerOps fetching the modules of the rewrite
+// table from mirrors of their git repositories, which are refreshed
+// every cacheExpire. Only tagged versions are served; other modules
+// and versions are reported as not found.
+type vcsOps struct {
+	root string // directory of the mirrors and of the zip cache
+
+	mu    sync.Mutex
+	repos map[string]*vcsRepo
+}
+
+// A vcsRepo is the mirror of a repository.
+type vcsRepo struct {
+	mu      sync.Mutex
+	dir     string
+	fetched time.Time
+}
+
+func newVCSOps(root string) *vcsOps {
+	return &vcsOps{root: root, repos: make(map[string]*vcsRepo)}
+}
+
+// NewContext returns the request context.
+func (o *vcsOps) NewContext(r *http.Request) (context.Context, error) {
+	return r.Context(), nil
+}
+
+// sync returns the directory of the up-to-date mirror of the repository url.
+func (o *vcsOps) sync(ctx context.Context, url string) (dir string, err error) {
+	o.mu.Lock()
+	repo := o.repos[url]
+	if repo == nil {
+		sum := sha256.Sum256([]byte(url))
+		repo = &vcsRepo{dir: filepath.Join(o.root, "git", hex.EncodeToString(sum[:8]))}
+		o.repos[url] = repo
+	}
+	o.mu.Unlock()
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if time.Since(repo.fetched) < cacheExpire {
+		return repo.dir, nil
+	}
+	release, err := downloadLimiter.Acquire(ctx, 1)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, vcsTimeout("git", downloadTimeout))
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+		vcsFetchDuration.With(prometheus.Labels{"vcs": "git", "status": status}).Observe(time.Since(start).Seconds())
+	}()
+	if _, err := os.Stat(repo.dir); err == nil {
+		_, err = runCommand(ctx, repo.dir, "git", "fetch", "--quiet", "--prune", "--tags", "origin")
+		if err != nil {
+			return "", err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(repo.dir), 0755); err != nil {
+			return "", err
+		}
+		_, err = runCommand(ctx, "", "git", "clone", "--mirror", "--quiet", url, repo.dir)
+		if err == nil {
+			// Archive the files like the go command does, whatever the platform.
+			_, err = runCommand(ctx, repo.dir, "git", "config", "core.autocrlf", "input")
+		}
+		if err == nil {
+			_, err = runCommand(ctx, repo.dir, "git", "config", "core.eol", "lf")
+		}
+		if err != nil {
+			os.RemoveAll(repo.dir)
+			return "", err
+		}
+	}
+	repo.fetched = time.Now()
+	return repo.dir, nil
+}
+
+// versions returns the tagged versions of the module mod, in semantic version order.
+func (o *vcsOps) versions(ctx context.Context, mod string) (*vcsModule, string, []string, error) {
+	m, ok := findVCSModule(mod)
+	if !ok {
+		return nil, "", nil, proxy.NewError(proxy.ErrNotFound, fmt.Errorf("%s is not in the rewrite table", mod))
+	}
+	if err := checkVCS(mod, "git"); err != nil {
+		return nil, "", nil, err
+	}
+	dir, err := o.sync(ctx, m.repo)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	out, err := runCommand(ctx, dir, "git", "tag", "--list", m.tagPrefix+"v*")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var versions []string
+	for _, tag := range strings.Fields(string(out)) {
+		v := strings.TrimPrefix(tag, m.tagPrefix)
+		switch {
+		case v != module.CanonicalVersion(v):
+		case module.CheckPathMajor(v, m.pathMajor) == nil:
+			versions = append(versions, v)
+		case m.pathMajor == "" && !o.hasGoMod(ctx, dir, tag, m.dir):
+			// Like the go command, serve the v2+ tags of a module
+			// without a go.mod file as +incompatible versions.
+			versions = append(versions, v+"+incompatible")
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+	return m, dir, versions, nil
+}
+
+// tag returns the module and the repository mirror of the tagged version m.
+func (o *vcsOps) tag(ctx context.Context, m module.Version) (*vcsModule, string, error) {
+	vm, dir, versions, err := o.versions(ctx, m.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, v := range versions {
+		if v == m.Version {
+			return vm, dir, nil
+		}
+	}
+	return nil, "", proxy.NewError(proxy.ErrNotFound, fmt.Errorf("%s: no tag %s", m.Path, vm.tag(m.Version)))
+}
+
+// hasGoMod reports whether the directory sub of the repository mirror dir
+// has a go.mod file at the given tag.
+func (o *vcsOps) hasGoMod(ctx context.Context, dir, tag, sub string) bool {
+	_, err := runCommand(ctx, dir, "git", "cat-file", "-e", tag+":"+path.Join(sub, "go.mod"))
+	return err == nil
+}
+
+// moduleDir returns the directory of the tagged version m in the repository:
+// the major version subdirectory if it has a go.mod file, like the go command.
+func (o *vcsOps) moduleDir(ctx context.Context, vm *vcsModule, dir string, m module.Version) string {
+	if vm.pathMajor != "" && strings.HasPrefix(vm.pathMajor, "/") {
+		sub := path.Join(vm.dir, vm.pathMajor[1:])
+		if o.hasGoMod(ctx, dir, vm.tag(m.Version), sub) {
+			return sub
+		}
+	}
+	return vm.dir
+}
+
+// List lists the tagged versions of the module.
+func (o *vcsOps) List(ctx context.Context, mod string) (proxy.File, error) {
+	_, _, versions, err := o.versions(ctx, mod)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, v := range versions {
+		fmt.Fprintln(&buf, v)
+	}
+	return proxy.MemFile(buf.Bytes(), time.Now()), nil
+}
+
+// Latest returns the info file of the latest tagged version of the module.
+func (o *vcsOps) Latest(ctx context.Context, mod string) (proxy.File, error) {
+	vm, dir, versions, err := o.versions(ctx, mod)
+	if err != nil {
+		return nil, err
+	}
+	latest := ""
+	for _, v := range versions {
+		if semver.Prerelease(v) == "" || latest == "" || semver.Prerelease(latest) != "" {
+			latest = v
+		}
+	}
+	if semver.Build(latest) == "+incompatible" {
+		// Like the go command, prefer the latest compatible version
+		// if it has a go.mod file.
+		compatible := ""
+		for _, v := range versions {
+			if semver.Build(v) == "" && (semver.Prerelease(v) == "" || compatible == "" || semver.Prerelease(compatible) != "") {
+				compatible = v
+			}
+		}
+		if compatible != "" && o.hasGoMod(ctx, dir, vm.tag(compatible), vm.dir) {
+			latest = compatible
+		}
+	}
+	if latest == "" {
+		return nil, proxy.NewError(proxy.ErrNotFound, fmt.Errorf("%s has no tagged versions", mod))
+	}
+	return o.Info(ctx, module.Version{Path: mod, Version: latest})
+}
+
+// Info returns the info file of a tagged version, with its commit time.
+func (o *vcsOps) Info(ctx context.Context, m module.Version) (proxy.File, error) {
+	vm, dir, err := o.tag(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	out, err := runCommand(ctx, dir, "git", "log", "-1", "--format=%ct", "refs/tags/"+vm.tag(m.Version))
+	if err != nil {
+		return nil, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("git log: %v", err)
+	}
+	return proxy.NewInfo(m.Version, time.Unix(sec, 0).UTC()), nil
+}
+
+// GoMod returns the go.mod file of a tagged version,
+// synthesizing one if it has none.
+func (o *vcsOps) GoMod(ctx context.Context, m module.Version) (proxy.File, error) {
+	vm, dir, err := o.tag(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	sub := o.moduleDir(ctx, vm, dir, m)
+	out, err := runCommand(ctx, dir, "git", "show", vm.tag(m.Version)+":"+path.Join(sub, "go.mod"))
+	if errors.Is(err, os.ErrNotExist) {
+		out, err = []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(m.Path))), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return proxy.MemFile(out, time.Now()), nil
+}
+
+// Zip returns the zip file of a tagged version,
+// created from git archive like the go command does.
+func (o *vcsOps) Zip(ctx context.Context, m module.Version) (proxy.File, error) {
+	escMod, err := module.EscapePath(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	escVers, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(o.root, "zip", escMod, "@v", escVers+".zip")
+	if f, err := os.Open(file); err == nil {
+		return f, nil
+	}
+	vm, dir, err := o.tag(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	sub := o.moduleDir(ctx, vm, dir, m)
+	command := []string{"git", "archive", "--format=zip", vm.tag(m.Version)}
+	if sub != "" {
+		command = append(command, sub)
+	}
+	out, err := runCommand(ctx, dir, command...)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		return nil, fmt.Errorf("git archive: %v", err)
+	}
+	var files []modzip.File
+	for _, f := range archive.File {
+		name := f.Name
+		if sub != "" {
+			if !strings.HasPrefix(name, sub+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(name, sub+"/")
+		}
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		files = append(files, archiveFile{f, name})
+	}
+	var buf bytes.Buffer
+	if err := modzip.Create(&buf, m, files); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	if err := renameio.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+// An archiveFile is a file of a git archive, as a module zip file entry.
+type archiveFile struct {
+	f    *zip.File
+	path string
+}
+
+func (f archiveFile) Path() string                 { return f.path }
+func (f archiveFile) Lstat() (os.FileInfo, error)  { return f.f.FileInfo(), nil }
+func (f archiveFile) Open() (io.ReadCloser, error) { return f.f.Open() }
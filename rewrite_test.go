@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+
+	"golang.org/x/mod/module"
+)
+
+// makeGitRepo creates a git repository in dir, with
+//
+//	v1.0.0, v4.0.0    r.go and sub/go.mod, without go.mod at the root
+//	sub/v1.0.0        the same commit
+//	v1.1.0, v3.0.0    go.mod, r.go, sub/ and v2/go.mod, v2/r.go
+//	v2.1.0            the same commit
+//	v1.2              the same commit, not a canonical version
+func makeGitRepo(t *testing.T, dir string) {
+	t.Helper()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=goproxy", "GIT_AUTHOR_EMAIL=goproxy@example.com",
+			"GIT_COMMITTER_NAME=goproxy", "GIT_COMMITTER_EMAIL=goproxy@example.com",
+			"GIT_AUTHOR_DATE=2020-01-02T03:04:05Z", "GIT_COMMITTER_DATE=2020-01-02T03:04:05Z",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	write := func(files map[string]string) {
+		t.Helper()
+		for name, data := range files {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	git("init", "--quiet")
+	write(map[string]string{
+		"r.go":       "package r\n",
+		"sub/go.mod": "module example.com/r/sub\n",
+		"sub/sub.go": "package sub\n",
+	})
+	git("add", ".")
+	git("commit", "--quiet", "-m", "first")
+	git("tag", "v1.0.0")
+	git("tag", "v4.0.0")
+	git("tag", "sub/v1.0.0")
+	write(map[string]string{
+		"go.mod":    "module example.com/r\n",
+		"v2/go.mod": "module example.com/r/v2\n",
+		"v2/r.go":   "package r // v2\n",
+	})
+	git("add", ".")
+	git("commit", "--quiet", "-m", "second")
+	git("tag", "v1.1.0")
+	git("tag", "v3.0.0")
+	git("tag", "v2.1.0")
+	git("tag", "v1.2")
+}
+
+func TestVCSOps(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "goproxy-rewrite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "repo")
+	if err := os.Mkdir(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	makeGitRepo(t, repo)
+
+	defer func(r []rewriteRule, l *proxy.Limiter, expire, timeout time.Duration) {
+		rewrites, downloadLimiter, cacheExpire, downloadTimeout = r, l, expire, timeout
+	}(rewrites, downloadLimiter, cacheExpire, downloadTimeout)
+	rewrites = []rewriteRule{{prefix: "example.com/r", repo: repo}}
+	downloadLimiter = proxy.NewLimiter("download", 1, 0)
+	cacheExpire, downloadTimeout = time.Hour, time.Minute
+
+	o := newVCSOps(filepath.Join(dir, "mirror"))
+	ctx := context.Background()
+	read := func(f proxy.File, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Tags map to versions by module, including the +incompatible ones.
+	for mod, want := range map[string]string{
+		"example.com/r":     "v1.0.0\nv1.1.0\nv4.0.0+incompatible\n",
+		"example.com/r/v2":  "v2.1.0\n",
+		"example.com/r/sub": "v1.0.0\n",
+	} {
+		if got := read(o.List(ctx, mod)); got != want {
+			t.Errorf("List(%s) = %q, want %q", mod, got, want)
+		}
+	}
+	if _, err := o.List(ctx, "example.org/other"); !isNotFound(err) {
+		t.Errorf("List of a module not rewritten: %v, want not found", err)
+	}
+
+	// The repository is mirrored, apart from the download cache.
+	mirrors, err := filepath.Glob(filepath.Join(dir, "mirror", "git", "*", "HEAD"))
+	if err != nil || len(mirrors) != 1 {
+		t.Errorf("mirrors = %v, %v, want one", mirrors, err)
+	}
+
+	// The latest compatible version has a go.mod file, so it wins over v4.
+	if got := read(o.Latest(ctx, "example.com/r")); !strings.Contains(got, `"Version":"v1.1.0"`) {
+		t.Errorf("Latest = %s, want v1.1.0", got)
+	}
+	if got := read(o.Info(ctx, module.Version{Path: "example.com/r", Version: "v4.0.0+incompatible"})); !strings.Contains(got, `"Time":"2020-01-02T03:04:05Z"`) {
+		t.Errorf("Info of v4.0.0+incompatible = %s", got)
+	}
+	if _, err := o.Info(ctx, module.Version{Path: "example.com/r", Version: "v3.0.0"}); !isNotFound(err) {
+		t.Errorf("Info of v3.0.0, with go.mod at the root: %v, want not found", err)
+	}
+
+	for m, want := range map[module.Version]string{
+		{Path: "example.com/r", Version: "v1.1.0"}:              "module example.com/r\n",
+		{Path: "example.com/r", Version: "v4.0.0+incompatible"}: "module example.com/r\n",
+		{Path: "example.com/r/v2", Version: "v2.1.0"}:           "module example.com/r/v2\n",
+		{Path: "example.com/r/sub", Version: "v1.0.0"}:          "module example.com/r/sub\n",
+	} {
+		if got := read(o.GoMod(ctx, m)); got != want {
+			t.Errorf("GoMod(%v) = %q, want %q", m, got, want)
+		}
+	}
+
+	// Zip files hold the module directory, the major version subdirectory
+	// if it has a go.mod file, without the nested modules.
+	for m, want := range map[module.Version][]string{
+		{Path: "example.com/r", Version: "v1.1.0"}:              {"go.mod", "r.go"},
+		{Path: "example.com/r", Version: "v4.0.0+incompatible"}: {"r.go"},
+		{Path: "example.com/r/v2", Version: "v2.1.0"}:           {"go.mod", "r.go"},
+		{Path: "example.com/r/sub", Version: "v1.0.0"}:          {"go.mod", "sub.go"},
+	} {
+		data := read(o.Zip(ctx, m))
+		z, err := zip.NewReader(bytes.NewReader([]byte(data)), int64(len(data)))
+		if err != nil {
+			t.Fatalf("Zip(%v): %v", m, err)
+		}
+		var names []string
+		for _, f := range z.File {
+			names = append(names, strings.TrimPrefix(f.Name, m.String()+"/"))
+		}
+		sort.Strings(names)
+		if strings.Join(names, " ") != strings.Join(want, " ") {
+			t.Errorf("Zip(%v) files = %v, want %v", m, names, want)
+		}
+	}
+	escMod, _ := module.EscapePath("example.com/r/v2")
+	if _, err := os.Stat(filepath.Join(dir, "mirror", "zip", escMod, "@v", "v2.1.0.zip")); err != nil {
+		t.Errorf("zip file not cached: %v", err)
+	}
+}
+
+func isNotFound(err error) bool {
+	return proxy.StatusCode(err) == http.StatusNotFound
+}
@@ -14,6 +14,12 @@ import (
 	"net/url"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var supportedSumDB = map[string][]string{
@@ -48,7 +54,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	result := make(chan *http.Response)
-	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second) // 2sec maybe enough
+	ctx, span := tracer().Start(r.Context(), "sumdb", trace.WithAttributes(attribute.String("sumdb.name", whichDB)))
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second) // 2sec maybe enough
 	defer cancel()
 
 	for _, host := range supportedSumDB[whichDB] {
@@ -59,18 +67,46 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	case resp := <-result:
 		{
 			defer resp.Body.Close()
+			span.SetAttributes(attribute.String("sumdb.host", resp.Request.URL.Host), attribute.Int("http.status_code", resp.StatusCode))
 			w.WriteHeader(resp.StatusCode)
 			if _, err := io.Copy(w, resp.Body); err != nil {
 				fmt.Fprint(w, err.Error())
 			}
 		}
 	case <-ctx.Done():
+		span.SetStatus(codes.Error, ctx.Err().Error())
 		w.WriteHeader(http.StatusGone)
 		fmt.Fprint(w, ctx.Err().Error())
 		return
 	}
 }
 
+// Check reports whether any upstream of the sum.golang.org checksum database
+// answers before ctx is done.
+func Check(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := make(chan *http.Response)
+	for _, host := range supportedSumDB["sum.golang.org"] {
+		go proxySumdb(ctx, host, "latest", result)
+	}
+	select {
+	case resp := <-result:
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("sumdb answered %s", resp.Status)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("sumdb unreachable: %v", ctx.Err())
+	}
+}
+
+// tracer creates the spans of this package.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/goproxyio/goproxy/v2/sumdb")
+}
+
 func parsePath(rawPath string) (whichDB, path string, err error) {
 	parts := strings.SplitN(rawPath, "/", 4)
 	if len(parts) < 4 {
@@ -88,14 +124,20 @@ func proxySumdb(ctx context.Context, host, path string, respChan chan<- *http.Re
 	}
 	urlPath.Path = path
 
+	ctx, span := tracer().Start(ctx, "sumdb.fetch", trace.WithAttributes(attribute.String("http.url", urlPath.String())))
+	defer span.End()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlPath.String(), nil)
 	if err != nil {
 		return
 	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return
 	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 
 	select {
 	case <-ctx.Done():
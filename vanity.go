@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// A vanityRule maps the import paths under a prefix to their repository,
+// for the go-import and go-source meta tags answering ?go-get=1.
+type vanityRule struct {
+	prefix string // import path prefix, like go.corp.example/x or go.corp.example/*
+	vcs    string // git, hg, svn, bzr, fossil or mod
+	repo   string // repository URL
+	// go-source templates, empty if the rule has none.
+	home, dir, file string
+}
+
+// vanity is the table read from the -vanity file,
+// longest prefixes first.
+var vanity []vanityRule
+
+// vanityVCS lists the version control systems of the go-import meta tags.
+var vanityVCS = map[string]bool{"git": true, "hg": true, "svn": true, "bzr": true, "fossil": true, "mod": true}
+
+// readVanity reads a vanity table from file, made of lines
+//
+//	<import path prefix> <vcs> <repository URL> [<home> <directory> <file>]
+//
+// ignoring blank lines and lines starting with #. A prefix ending in /*
+// matches any path element, substituted for {name} in the other fields.
+func readVanity(file string) ([]vanityRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []vanityRule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 6 {
+			return nil, fmt.Errorf("%s:%d: want <import path prefix> <vcs> <repository URL> [<home> <directory> <file>]", file, n)
+		}
+		if err := module.CheckImportPath(strings.TrimSuffix(fields[0], "/*")); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		if !vanityVCS[fields[1]] {
+			return nil, fmt.Errorf("%s:%d: unknown vcs %q", file, n, fields[1])
+		}
+		rule := vanityRule{prefix: fields[0], vcs: fields[1], repo: fields[2]}
+		if len(fields) == 6 {
+			rule.home, rule.dir, rule.file = fields[3], fields[4], fields[5]
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	return rules, nil
+}
+
+// A goImport is the content of the page answering a ?go-get=1 request.
+type goImport struct {
+	Path   string // requested import path
+	Prefix string // repository root path
+	VCS    string
+	Repo   string
+	// Subdir is the directory of Prefix in the repository, for the
+	// rewrite rules having one. Only the go command of Go 1.25 and later
+	// reads this fourth field of go-import; earlier ones ignore the tag.
+	Subdir string
+	// go-source templates, empty if unknown.
+	Home, Dir, File string
+}
+
+// lookupGoImport returns the meta tags for the import path p,
+// from the vanity table or else the rewrite table.
+func lookupGoImport(p string) (*goImport, bool) {
+	// p comes from the request: check it before substituting
+	// one of its elements for {name}.
+	if module.CheckImportPath(p) != nil {
+		return nil, false
+	}
+	for _, rule := range vanity {
+		root := rule.prefix
+		name := ""
+		if base := strings.TrimSuffix(rule.prefix, "/*"); base != rule.prefix {
+			if !strings.HasPrefix(p, base+"/") {
+				continue
+			}
+			name = strings.SplitN(p[len(base)+1:], "/", 2)[0]
+			root = base + "/" + name
+		}
+		if p != root && !strings.HasPrefix(p, root+"/") {
+			continue
+		}
+		expand := func(s string) string { return strings.ReplaceAll(s, "{name}", name) }
+		return &goImport{
+			Path:   p,
+			Prefix: root,
+			VCS:    rule.vcs,
+			Repo:   expand(rule.repo),
+			Home:   expand(rule.home),
+			Dir:    expand(rule.dir),
+			File:   expand(rule.file),
+		}, true
+	}
+	if rule, ok := lookupRewrite(p); ok {
+		return &goImport{Path: p, Prefix: rule.prefix, VCS: "git", Repo: rule.repo, Subdir: rule.subdir}, true
+	}
+	return nil, false
+}
+
+// goImportTmpl is the page answering ?go-get=1 requests.
+var goImportTmpl = template.Must(template.New("go-import").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="{{.Prefix}} {{.VCS}} {{.Repo}}{{with .Subdir}} {{.}}{{end}}">
+{{- if .Home}}
+<meta name="go-source" content="{{.Prefix}} {{.Home}} {{.Dir}} {{.File}}">
+{{- end}}
+</head>
+<body>
+go get {{.Path}}{{with .Home}}, see <a href="{{.}}">{{.}}</a>{{end}}
+</body>
+</html>
+`))
+
+// serveGoGet answers the ?go-get=1 requests for the import paths of the
+// vanity and rewrite tables with go-import and go-source meta tags,
+// and reports whether it did.
+func serveGoGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Query().Get("go-get") != "1" {
+		return false
+	}
+	imp, ok := lookupGoImport(r.Host + strings.TrimSuffix(r.URL.Path, "/"))
+	if !ok {
+		// Also accept the import path without the host of the proxy.
+		if imp, ok = lookupGoImport(strings.Trim(r.URL.Path, "/")); !ok {
+			return false
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	goImportTmpl.Execute(w, imp)
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLookupGoImport(t *testing.T) {
+	defer func(v []vanityRule, r []rewriteRule) { vanity, rewrites = v, r }(vanity, rewrites)
+	vanity = []vanityRule{
+		{prefix: "go.corp.example/tools", vcs: "mod", repo: "https://goproxy.corp.example"},
+		{prefix: "go.corp.example/*", vcs: "git", repo: "https://git.corp.example/go/{name}",
+			home: "https://git.corp.example/go/{name}", dir: "{/dir}", file: "{/dir}/{file}#L{line}"},
+	}
+	rewrites = []rewriteRule{
+		{prefix: "go.corp.example/tools/x", repo: "https://git.corp.example/x.git"},
+		{prefix: "other.example/lib", repo: "https://git.other.example/lib.git", subdir: "go"},
+	}
+
+	tests := []struct {
+		path string
+		want *goImport
+	}{
+		{"go.corp.example/tools/cmd", &goImport{Path: "go.corp.example/tools/cmd", Prefix: "go.corp.example/tools", VCS: "mod", Repo: "https://goproxy.corp.example"}},
+		{"go.corp.example/api/v2/client", &goImport{Path: "go.corp.example/api/v2/client", Prefix: "go.corp.example/api", VCS: "git",
+			Repo: "https://git.corp.example/go/api", Home: "https://git.corp.example/go/api", Dir: "{/dir}", File: "{/dir}/{file}#L{line}"}},
+		{"go.corp.example/api", &goImport{Path: "go.corp.example/api", Prefix: "go.corp.example/api", VCS: "git",
+			Repo: "https://git.corp.example/go/api", Home: "https://git.corp.example/go/api", Dir: "{/dir}", File: "{/dir}/{file}#L{line}"}},
+		{"other.example/lib/sub", &goImport{Path: "other.example/lib/sub", Prefix: "other.example/lib", VCS: "git", Repo: "https://git.other.example/lib.git", Subdir: "go"}},
+		{"go.corp.example", nil},
+		{"other.example/library", nil},
+		// Malformed paths are not substituted for {name}.
+		{"go.corp.example/../x", nil},
+		{"go.corp.example/a:b", nil},
+		{"go.corp.example/a//b", nil},
+		{"go.corp.example/", nil},
+	}
+	for _, tt := range tests {
+		got, ok := lookupGoImport(tt.path)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookupGoImport(%q) = %+v, %v, want %+v", tt.path, got, ok, tt.want)
+		}
+	}
+}
+
+func TestServeGoGet(t *testing.T) {
+	defer func(v []vanityRule, r []rewriteRule) { vanity, rewrites = v, r }(vanity, rewrites)
+	vanity = []vanityRule{
+		{prefix: "go.corp.example/*", vcs: "git", repo: "https://git.corp.example/go/{name}",
+			home: "https://git.corp.example/go/{name}", dir: "https://git.corp.example/go/{name}/tree/main{/dir}",
+			file: "https://git.corp.example/go/{name}/blob/main{/dir}/{file}#L{line}"},
+	}
+	rewrites = []rewriteRule{{prefix: "other.example/lib", repo: "https://git.other.example/lib.git", subdir: "go"}}
+
+	tests := []struct {
+		host, target string
+		served       bool
+		want         []string
+	}{
+		// The domain points at goproxy.
+		{"go.corp.example", "/api/client?go-get=1", true, []string{
+			`<meta name="go-import" content="go.corp.example/api git https://git.corp.example/go/api">`,
+			`<meta name="go-source" content="go.corp.example/api https://git.corp.example/go/api https://git.corp.example/go/api/tree/main{/dir} https://git.corp.example/go/api/blob/main{/dir}/{file}#L{line}">`,
+			`go get go.corp.example/api/client, see <a href="https://git.corp.example/go/api">`,
+		}},
+		// The import path is the request path.
+		{"goproxy.corp.example:8081", "/other.example/lib/sub/?go-get=1", true, []string{
+			`<meta name="go-import" content="other.example/lib git https://git.other.example/lib.git go">`,
+		}},
+		{"goproxy.corp.example", "/go.corp.example/api?go-get=1", true, []string{
+			`<meta name="go-import" content="go.corp.example/api git`,
+		}},
+		{"go.corp.example", "/api/client", false, nil},
+		{"go.corp.example", "/api/client?go-get=0", false, nil},
+		{"goproxy.corp.example", "/unknown.example/x?go-get=1", false, nil},
+		{"go.corp.example", "/%3Cscript%3E?go-get=1", false, nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		r.Host = tt.host
+		rec := httptest.NewRecorder()
+		if served := serveGoGet(rec, r); served != tt.served {
+			t.Errorf("%s%s: served = %v, want %v", tt.host, tt.target, served, tt.served)
+			continue
+		}
+		if !tt.served {
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("%s%s: Content-Type %q", tt.host, tt.target, ct)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("%s%s: missing %s in\n%s", tt.host, tt.target, want, rec.Body)
+			}
+		}
+		// Rewrite rules have no go-source templates.
+		if strings.HasPrefix(tt.target, "/other.example/") && strings.Contains(rec.Body.String(), "go-source") {
+			t.Errorf("%s%s: unexpected go-source in\n%s", tt.host, tt.target, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/mod/module"
+)
+
+var vcsFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "goproxy",
+	Subsystem: "vcs",
+	Name:      "fetch_duration_seconds",
+	Help:      "time spent fetching modules directly, by version control system",
+	Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+}, []string{"vcs", "status"})
+
+func init() {
+	prometheus.MustRegister(vcsFetchDuration)
+}
+
+// A vcsRule is an entry of the VCS policy, in GOVCS syntax:
+// a module path pattern, public or private, and the allowed
+// version control systems, all or off.
+type vcsRule struct {
+	pattern string
+	allowed []string
+}
+
+func (r vcsRule) String() string {
+	return r.pattern + ":" + strings.Join(r.allowed, "|")
+}
+
+// defaultVCSPolicy is the policy of the go command when GOVCS is unset.
+var defaultVCSPolicy = []vcsRule{
+	{"private", []string{"all"}},
+	{"public", []string{"git", "hg"}},
+}
+
+// vcsPolicy is the policy read from the -vcs flag,
+// followed by the default policy.
+var vcsPolicy []vcsRule
+
+// vcsTimeouts maps version control systems to the timeout of
+// the direct fetches of their modules, from the -vcsTimeout flag.
+var vcsTimeouts map[string]time.Duration
+
+// parseVCSPolicy parses a policy in GOVCS syntax, like
+// "private:git|hg,*.corp.example:svn,public:off".
+func parseVCSPolicy(s string) ([]vcsRule, error) {
+	var rules []vcsRule
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("malformed entry %q: missing colon", item)
+		}
+		pattern, list := strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		if pattern == "" || list == "" {
+			return nil, fmt.Errorf("malformed entry %q: empty pattern or list", item)
+		}
+		if seen[pattern] {
+			return nil, fmt.Errorf("multiple entries for %s", pattern)
+		}
+		seen[pattern] = true
+		allowed := strings.Split(list, "|")
+		for _, vcs := range allowed {
+			if (vcs == "all" || vcs == "off") && len(allowed) > 1 {
+				return nil, fmt.Errorf("malformed entry %q: %s must be alone", item, vcs)
+			}
+			if vcs == "" {
+				return nil, fmt.Errorf("malformed entry %q: empty version control system", item)
+			}
+		}
+		rules = append(rules, vcsRule{pattern, allowed})
+	}
+	return rules, nil
+}
+
+// vcsRuleFor returns the first rule of the policy matching the module path mpath.
+func vcsRuleFor(mpath string) (vcsRule, bool) {
+	private := module.MatchPrefixPatterns(os.Getenv("GOPRIVATE"), mpath)
+	for _, r := range vcsPolicy {
+		var match bool
+		switch r.pattern {
+		case "public":
+			match = !private
+		case "private":
+			match = private
+		default:
+			match = module.MatchPrefixPatterns(r.pattern, mpath)
+		}
+		if match {
+			return r, true
+		}
+	}
+	return vcsRule{}, false
+}
+
+// checkVCS returns an error naming the policy rule
+// if it disallows fetching the module mpath with vcs.
+func checkVCS(mpath, vcs string) error {
+	if vcs == "mod" {
+		// Like the go command, always allow the proxy protocol.
+		return nil
+	}
+	r, ok := vcsRuleFor(mpath)
+	if !ok {
+		return nil
+	}
+	for _, allowed := range r.allowed {
+		if allowed == "all" || allowed == vcs {
+			return nil
+		}
+	}
+	return proxy.NewError(proxy.ErrForbidden, fmt.Errorf("%s: vcs policy rule %q disallows %s", mpath, r, vcs))
+}
+
+// vcsTimeout returns the timeout of the direct fetches with vcs,
+// or else timeout.
+func vcsTimeout(vcs string, timeout time.Duration) time.Duration {
+	if d, ok := vcsTimeouts[vcs]; ok {
+		return d
+	}
+	return timeout
+}
+
+// knownVCS caches the version control system of the modules
+// learned from the go command, by module path.
+var knownVCS sync.Map
+
+// vcsPathElem matches path elements naming their version control system.
+var vcsPathElem = regexp.MustCompile(`\.(bzr|fossil|git|hg|svn)$`)
+
+// moduleVCS returns the version control system of the module mpath
+// if it is known without running the go command, or else "".
+func moduleVCS(mpath string) string {
+	if vcs, ok := knownVCS.Load(mpath); ok {
+		return vcs.(string)
+	}
+	if _, ok := lookupRewrite(mpath); ok {
+		return "git"
+	}
+	host, _, _ := strings.Cut(mpath, "/")
+	switch host {
+	case "github.com", "bitbucket.org":
+		return "git"
+	case "launchpad.net":
+		return "bzr"
+	case "chiselapp.com":
+		return "fossil"
+	}
+	for elem := mpath; elem != "." && elem != "/"; elem = path.Dir(elem) {
+		if m := vcsPathElem.FindStringSubmatch(path.Base(elem)); m != nil && elem != host {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// govcsRefusal matches the go command failures caused by GOVCS.
+var govcsRefusal = regexp.MustCompile(`GOVCS disallows using (\w+) for (?:public|private) (\S+);`)
+
+// credentialPrompt matches the git failures to prompt for credentials.
+var credentialPrompt = regexp.MustCompile(`terminal prompts disabled|could not read (Username|Password)`)
+
+// goFetch runs the go command fetching the module mpath directly and
+// parses its JSON output into dst. The command is run within the timeout
+// of the version control system of the module, if known, or else timeout.
+// Fetches disallowed by the VCS policy fail with an error naming its rule,
+// credential prompts fail with ErrVCSAuth for the private modules and with
+// ErrNotFound for the public ones, and the duration of the fetches is
+// recorded per version control system.
+func goFetch(ctx context.Context, mpath string, timeout time.Duration, dst interface{}, command ...string) error {
+	vcs := moduleVCS(mpath)
+	if vcs != "" {
+		if err := checkVCS(mpath, vcs); err != nil {
+			vcsFetchDuration.With(prometheus.Labels{"vcs": vcs, "status": "refused"}).Observe(0)
+			return err
+		}
+		timeout = vcsTimeout(vcs, timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	stdout, err := runCommand(ctx, "", command...)
+	status := "ok"
+	if err == nil {
+		var origin struct {
+			Origin struct{ VCS string }
+		}
+		if err = json.Unmarshal(stdout, dst); err != nil {
+			err = fmt.Errorf("%s: reading json: %v", strings.Join(command, " "), err)
+		} else if json.Unmarshal(stdout, &origin) == nil && origin.Origin.VCS != "" {
+			vcs = origin.Origin.VCS
+			knownVCS.Store(mpath, vcs)
+		}
+	} else if m := govcsRefusal.FindStringSubmatch(err.Error()); m != nil {
+		vcs, status = m[1], "refused"
+		knownVCS.Store(mpath, vcs)
+		if rerr := checkVCS(m[2], vcs); rerr != nil {
+			err = rerr
+		}
+	}
+	if errors.Is(err, proxy.ErrVCSAuth) && credentialPrompt.MatchString(err.Error()) &&
+		!module.MatchPrefixPatterns(os.Getenv("GOPRIVATE"), mpath) {
+		// A public host asking for credentials most likely
+		// has no such repository: report the module as not found.
+		// The private modules keep failing loudly, as the proxy
+		// credentials are likely missing or expired.
+		err = proxy.NewError(proxy.ErrNotFound, err)
+	}
+	if err != nil && status == "ok" {
+		status = "error"
+	}
+	if vcs == "" {
+		vcs = "unknown"
+	}
+	vcsFetchDuration.With(prometheus.Labels{"vcs": vcs, "status": status}).Observe(time.Since(start).Seconds())
+	return err
+}
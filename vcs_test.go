@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+)
+
+func TestParseVCSPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // rules joined by commas, or the error
+	}{
+		{"", ""},
+		{"private:git|hg, *.corp.example:svn ,public:off", "private:git|hg,*.corp.example:svn,public:off"},
+		{"public:all", "public:all"},
+		{",,private:all,", "private:all"},
+		{"private", `malformed entry "private": missing colon`},
+		{":git", `malformed entry ":git": empty pattern or list`},
+		{"private:", `malformed entry "private:": empty pattern or list`},
+		{"private:git,private:hg", "multiple entries for private"},
+		{"public:all|git", `malformed entry "public:all|git": all must be alone`},
+		{"public:git|off", `malformed entry "public:git|off": off must be alone`},
+		{"public:git||hg", `malformed entry "public:git||hg": empty version control system`},
+	}
+	for _, tt := range tests {
+		rules, err := parseVCSPolicy(tt.in)
+		var got string
+		if err != nil {
+			got = err.Error()
+		} else {
+			var s []string
+			for _, r := range rules {
+				s = append(s, r.String())
+			}
+			got = strings.Join(s, ",")
+		}
+		if got != tt.want {
+			t.Errorf("parseVCSPolicy(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckVCS(t *testing.T) {
+	defer func(p []vcsRule) { vcsPolicy = p }(vcsPolicy)
+	t.Setenv("GOPRIVATE", "*.corp.example,github.com/corp")
+	rules, err := parseVCSPolicy("svn.corp.example:svn,*.corp.example:off,public:git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcsPolicy = append(rules, defaultVCSPolicy...)
+
+	tests := []struct {
+		mod, vcs string
+		rule     string // rule refusing, if any
+	}{
+		{"svn.corp.example/x", "svn", ""},
+		{"svn.corp.example/x", "git", "svn.corp.example:svn"},
+		{"git.corp.example/x", "git", "*.corp.example:off"},
+		// Like any module, proxy protocol ones are allowed.
+		{"git.corp.example/x", "mod", ""},
+		// GOPRIVATE modules fall through to the private:all default.
+		{"github.com/corp/x", "hg", ""},
+		{"github.com/corp/x", "bzr", ""},
+		{"github.com/public/x", "git", ""},
+		{"github.com/public/x", "hg", "public:git"},
+	}
+	for _, tt := range tests {
+		err := checkVCS(tt.mod, tt.vcs)
+		switch {
+		case tt.rule == "" && err != nil:
+			t.Errorf("checkVCS(%s, %s) = %v, want nil", tt.mod, tt.vcs, err)
+		case tt.rule != "" && (!errors.Is(err, proxy.ErrForbidden) || !strings.Contains(err.Error(), `rule "`+tt.rule+`" disallows `+tt.vcs)):
+			t.Errorf("checkVCS(%s, %s) = %v, want refusal by %s", tt.mod, tt.vcs, err, tt.rule)
+		}
+	}
+
+	// The default policy applies without -vcs.
+	vcsPolicy = defaultVCSPolicy
+	if err := checkVCS("github.com/public/x", "svn"); err == nil || !strings.Contains(err.Error(), `rule "public:git|hg"`) {
+		t.Errorf("checkVCS of svn for a public module = %v, want refusal by public:git|hg", err)
+	}
+	if err := checkVCS("git.corp.example/x", "svn"); err != nil {
+		t.Errorf("checkVCS of svn for a private module = %v, want nil", err)
+	}
+}
+
+func TestModuleVCS(t *testing.T) {
+	defer func(r []rewriteRule) { rewrites = r }(rewrites)
+	rewrites = []rewriteRule{{prefix: "go.corp.example/x", repo: "https://git.corp.example/x.git"}}
+	knownVCS.Store("example.com/learned", "hg")
+	defer knownVCS.Delete("example.com/learned")
+
+	tests := []struct {
+		mod, want string
+	}{
+		{"github.com/x/y", "git"},
+		{"bitbucket.org/x/y", "git"},
+		{"launchpad.net/x", "bzr"},
+		{"chiselapp.com/user/x/repository/y", "fossil"},
+		{"go.corp.example/x/sub", "git"},
+		{"example.com/repo.git/sub", "git"},
+		{"example.com/repo.hg", "hg"},
+		{"example.com/learned", "hg"},
+		{"example.com/m", ""},
+		// A host name is not a repository.
+		{"example.git/m", ""},
+	}
+	for _, tt := range tests {
+		if got := moduleVCS(tt.mod); got != tt.want {
+			t.Errorf("moduleVCS(%s) = %q, want %q", tt.mod, got, tt.want)
+		}
+	}
+}
+
+func TestGOVCSRefusal(t *testing.T) {
+	defer func(p []vcsRule) { vcsPolicy = p }(vcsPolicy)
+	vcsPolicy = []vcsRule{{"public", []string{"git"}}}
+
+	out := "go: example.com/m@v1.0.0: unrecognized import path \"example.com/m\": " +
+		"GOVCS disallows using hg for public example.com/m; see 'go help vcs'"
+	m := govcsRefusal.FindStringSubmatch(out)
+	if m == nil || m[1] != "hg" || m[2] != "example.com/m" {
+		t.Fatalf("govcsRefusal.FindStringSubmatch = %q", m)
+	}
+	if err := checkVCS(m[2], m[1]); err == nil || err.Error() != `forbidden: example.com/m: vcs policy rule "public:git" disallows hg` {
+		t.Errorf("refusal = %v", err)
+	}
+	if govcsRefusal.MatchString("go: example.com/m: unknown revision v1.0.0") {
+		t.Error("govcsRefusal matches other failures")
+	}
+}
+
+func TestGoFetchCredentialPrompt(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	t.Setenv("GOPRIVATE", "git.corp.example")
+	prompt := "echo \"fatal: could not read Username for 'https://host': terminal prompts disabled\" >&2; exit 128"
+	for _, tt := range []struct {
+		mod  string
+		kind error
+		code int
+	}{
+		// Missing or expired credentials must not look like missing modules.
+		{"git.corp.example/x", proxy.ErrVCSAuth, http.StatusBadGateway},
+		// Public hosts ask for credentials for the repositories that do not exist.
+		{"github.com/x/typo", proxy.ErrNotFound, http.StatusNotFound},
+	} {
+		var dst struct{}
+		err := goFetch(context.Background(), tt.mod, time.Minute, &dst, "sh", "-c", prompt)
+		if !errors.Is(err, tt.kind) || proxy.StatusCode(err) != tt.code {
+			t.Errorf("goFetch(%s) = %v (status %d), want %v (status %d)", tt.mod, err, proxy.StatusCode(err), tt.kind, tt.code)
+		}
+	}
+}